@@ -0,0 +1,300 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+	"time"
+
+	"gopkg.in/yaml.v3"
+
+	"github.com/Li-Elias/Railclone/internal/challenge"
+	"github.com/Li-Elias/Railclone/internal/mail"
+	"github.com/Li-Elias/Railclone/internal/validator"
+)
+
+// envPrefix is the prefix of the environment variables that set flags, e.g.
+// RAILCLONE_DB_DSN sets -db-dsn. RAILCLONE_DB_DSN_FILE reads it from a file.
+const envPrefix = "RAILCLONE_"
+
+// secretFlags are the flags whose values are redacted by -print-config.
+var secretFlags = map[string]bool{
+	"db-dsn":             true,
+	"smtp-password":      true,
+	"oidc-client-secret": true,
+	"redis-dsn":          true,
+	"pow-secret":         true,
+	"captcha-secret":     true,
+}
+
+// loadConfig fills in the flags of fs that were not set on the command line,
+// first from the YAML config file and then from the environment, so the
+// precedence is defaults < config file < environment < flags. It must be
+// called after fs.Parse.
+func loadConfig(fs *flag.FlagSet, path string) error {
+	explicit := map[string]bool{}
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
+
+	if path == "" {
+		path = os.Getenv(envPrefix + "CONFIG")
+	}
+
+	if path != "" {
+		values, err := readConfigFile(path)
+		if err != nil {
+			return err
+		}
+
+		for name, value := range values {
+			err = setConfigValue(fs, explicit, name, value, path)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	var err error
+	fs.VisitAll(func(f *flag.Flag) {
+		if err != nil || explicit[f.Name] {
+			return
+		}
+
+		key := envPrefix + strings.ToUpper(strings.ReplaceAll(f.Name, "-", "_"))
+
+		if value, ok := os.LookupEnv(key); ok {
+			err = setFlag(fs, f.Name, value, key)
+			return
+		}
+
+		if file, ok := os.LookupEnv(key + "_FILE"); ok {
+			var value string
+			value, err = readSecretFile(file)
+			if err != nil {
+				return
+			}
+			err = setFlag(fs, f.Name, value, key+"_FILE")
+		}
+	})
+
+	return err
+}
+
+// readConfigFile reads a YAML config file into flag names and values. Keys are
+// flag names, and nested mappings are joined with dashes, so both
+// "db-dsn: ..." and "db: {dsn: ...}" set -db-dsn. Sequences are joined with
+// spaces.
+func readConfigFile(path string) (map[string]string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var doc map[string]interface{}
+	err = yaml.Unmarshal(data, &doc)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+
+	values := map[string]string{}
+	flattenConfig(values, "", doc)
+
+	return values, nil
+}
+
+func flattenConfig(values map[string]string, prefix string, doc map[string]interface{}) {
+	for key, value := range doc {
+		name := key
+		if prefix != "" {
+			name = prefix + "-" + key
+		}
+
+		switch value := value.(type) {
+		case map[string]interface{}:
+			flattenConfig(values, name, value)
+		case []interface{}:
+			items := make([]string, len(value))
+			for i, item := range value {
+				items[i] = fmt.Sprint(item)
+			}
+			values[name] = strings.Join(items, " ")
+		case nil:
+			values[name] = ""
+		default:
+			values[name] = fmt.Sprint(value)
+		}
+	}
+}
+
+// setConfigValue sets a flag from the config file. A key with a "-file" suffix
+// reads the value of the flag from that file instead.
+func setConfigValue(fs *flag.FlagSet, explicit map[string]bool, name, value, path string) error {
+	if fs.Lookup(name) == nil {
+		trimmed, ok := strings.CutSuffix(name, "-file")
+		if !ok || fs.Lookup(trimmed) == nil {
+			return fmt.Errorf("%s: unknown configuration key %q", path, name)
+		}
+
+		if explicit[trimmed] {
+			return nil
+		}
+
+		secret, err := readSecretFile(value)
+		if err != nil {
+			return err
+		}
+		return setFlag(fs, trimmed, secret, path)
+	}
+
+	if explicit[name] {
+		return nil
+	}
+
+	return setFlag(fs, name, value, path)
+}
+
+func setFlag(fs *flag.FlagSet, name, value, source string) error {
+	if name == "config" || name == "print-config" || name == "version" {
+		return nil
+	}
+
+	err := fs.Set(name, value)
+	if err != nil {
+		return fmt.Errorf("%s: invalid value for %s: %w", source, name, err)
+	}
+
+	return nil
+}
+
+func readSecretFile(path string) (string, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+
+	return strings.TrimRight(string(data), "\r\n"), nil
+}
+
+// printConfig writes the effective configuration as YAML that can be used as
+// a config file, with the secrets redacted.
+func printConfig(w io.Writer, fs *flag.FlagSet) error {
+	var names []string
+	fs.VisitAll(func(f *flag.Flag) {
+		if f.Name != "config" && f.Name != "print-config" && f.Name != "version" {
+			names = append(names, f.Name)
+		}
+	})
+	sort.Strings(names)
+
+	doc := &yaml.Node{Kind: yaml.MappingNode}
+	for _, name := range names {
+		value := fs.Lookup(name).Value.String()
+		if secretFlags[name] {
+			value = redact(value)
+		}
+
+		doc.Content = append(doc.Content,
+			&yaml.Node{Kind: yaml.ScalarNode, Value: name},
+			&yaml.Node{Kind: yaml.ScalarNode, Value: value},
+		)
+	}
+
+	enc := yaml.NewEncoder(w)
+	defer enc.Close()
+
+	return enc.Encode(doc)
+}
+
+// redact hides a secret. URLs keep everything but their password, so that
+// the DSNs can still be checked.
+func redact(value string) string {
+	if value == "" {
+		return ""
+	}
+
+	u, err := url.Parse(value)
+	if err == nil && u.Scheme != "" && u.User != nil {
+		if _, ok := u.User.Password(); ok {
+			return u.Redacted()
+		}
+	}
+
+	return "xxxxx"
+}
+
+// fieldsValue is a flag.Value of space separated strings.
+type fieldsValue []string
+
+func (f *fieldsValue) Set(value string) error {
+	*f = strings.Fields(value)
+	return nil
+}
+
+func (f *fieldsValue) String() string {
+	if f == nil {
+		return ""
+	}
+	return strings.Join(*f, " ")
+}
+
+func validateConfig(v *validator.Validator, cfg *config) {
+	v.Check(cfg.port > 0 && cfg.port <= 65535, "port", "must be a valid port")
+	v.Check(validator.PermittedValue(cfg.env, "development", "staging", "production"), "env", "must be development, staging or production")
+	v.Check(validator.PermittedValue(cfg.migrate, "", "up", "down", "status"), "migrate", "must be up, down or status")
+
+	v.Check((cfg.tls.certFile == "") == (cfg.tls.keyFile == ""), "tls-key", "must be provided together with tls-cert")
+	if cfg.tls.redirectPort != 0 {
+		v.Check(cfg.tls.certFile != "", "tls-redirect-port", "requires tls-cert")
+		v.Check(cfg.tls.redirectPort > 0 && cfg.tls.redirectPort <= 65535, "tls-redirect-port", "must be a valid port")
+		v.Check(cfg.tls.redirectPort != cfg.port, "tls-redirect-port", "must differ from port")
+	}
+	v.Check(cfg.tls.reloadInterval > 0, "tls-reload-interval", "must be greater than zero")
+
+	v.Check(cfg.DB.Dsn != "", "db-dsn", "must be provided")
+	v.Check(cfg.DB.MaxOpenConns > 0, "db-max-open-conns", "must be greater than zero")
+	v.Check(cfg.DB.MaxIdleConns >= 0, "db-max-idle-conns", "must not be negative")
+	_, err := time.ParseDuration(cfg.DB.MaxIdleTime)
+	v.Check(err == nil, "db-max-idle-time", "must be a duration")
+	v.Check(cfg.DB.QueryTimeout > 0, "db-query-timeout", "must be greater than zero")
+
+	v.Check(validator.PermittedValue(cfg.mail.Transport, mail.TransportSMTP, mail.TransportConsole, mail.TransportMaildir, mail.TransportMemory), "mail-transport", "must be smtp, console, maildir or memory")
+	v.Check(cfg.mail.Sender != "", "mail-sender", "must be provided")
+	if cfg.mail.Transport == mail.TransportSMTP {
+		v.Check(cfg.mail.SMTP.Host != "", "smtp-host", "must be provided")
+		v.Check(cfg.mail.SMTP.Port > 0 && cfg.mail.SMTP.Port <= 65535, "smtp-port", "must be a valid port")
+	}
+	v.Check(cfg.outbox.pollInterval > 0, "mail-outbox-interval", "must be greater than zero")
+	v.Check(cfg.outbox.maxAttempts > 0, "mail-max-attempts", "must be greater than zero")
+
+	if cfg.oidc.Enabled() {
+		v.Check(cfg.oidc.ClientID != "", "oidc-client-id", "must be provided")
+		v.Check(cfg.oidc.RedirectURL != "", "oidc-redirect-url", "must be provided")
+	}
+
+	v.Check(cfg.tokenQuota.EmailLimit > 0, "token-email-quota", "must be greater than zero")
+	v.Check(cfg.tokenQuota.IPLimit > 0, "token-ip-quota", "must be greater than zero")
+	v.Check(cfg.tokenQuota.Window > 0, "token-quota-window", "must be greater than zero")
+
+	v.Check(validator.PermittedValue(cfg.challenge.kind, challenge.KindNone, challenge.KindProofOfWork, challenge.KindCaptcha), "token-challenge", "must be none, pow or captcha")
+	if cfg.challenge.kind == challenge.KindProofOfWork {
+		v.Check(cfg.challenge.powDifficulty > 0 && cfg.challenge.powDifficulty <= 32, "pow-difficulty", "must be between 1 and 32")
+	}
+	if cfg.challenge.kind == challenge.KindCaptcha {
+		v.Check(cfg.challenge.captchaURL != "", "captcha-verify-url", "must be provided")
+		v.Check(cfg.challenge.captchaSecret != "", "captcha-secret", "must be provided")
+	}
+
+	v.Check(cfg.webhooks.pollInterval > 0, "webhook-interval", "must be greater than zero")
+	v.Check(cfg.webhooks.maxAttempts > 0, "webhook-max-attempts", "must be greater than zero")
+	v.Check(cfg.webhooks.concurrency > 0, "webhook-concurrency", "must be greater than zero")
+	v.Check(cfg.webhooks.timeout > 0, "webhook-timeout", "must be greater than zero")
+
+	v.Check(cfg.shutdownDelay >= 0, "shutdown-delay", "must not be negative")
+	v.Check(cfg.kubeTimeout > 0, "kube-timeout", "must be greater than zero")
+	v.Check(cfg.deletionSweepInterval > 0, "deletion-sweep-interval", "must be greater than zero")
+}
@@ -4,6 +4,7 @@ import (
 	"context"
 	"net/http"
 
+	"github.com/Li-Elias/Railclone/internal/i18n"
 	"github.com/Li-Elias/Railclone/internal/models"
 )
 
@@ -23,3 +24,14 @@ func (app *application) contextGetUser(r *http.Request) *models.User {
 	}
 	return user
 }
+
+// locale returns the locale of the authenticated user, or the one preferred
+// by the Accept-Language header for anonymous requests. Errors can be sent
+// before authenticate has run, so a missing user is not an error here.
+func (app *application) locale(r *http.Request) string {
+	user, ok := r.Context().Value(userContextKey).(*models.User)
+	if ok && !user.IsAnonymous() && i18n.IsSupported(user.Locale) {
+		return user.Locale
+	}
+	return i18n.Match(r.Header.Get("Accept-Language"))
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+const deliveryLease = 2 * time.Minute
+
+func (app *application) runDeliveryWorker(ctx context.Context) {
+	ticker := time.NewTicker(app.config.webhooks.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := app.deliverWebhooks(ctx)
+			if err != nil && !errors.Is(err, models.ErrCanceled) {
+				app.logger.PrintError(err, map[string]string{
+					"worker": "webhook deliveries",
+				})
+			}
+		}
+	}
+}
+
+// deliverWebhooks sends every webhook delivery that is due until there is
+// nothing left to claim. Up to -webhook-concurrency deliveries are claimed
+// and sent at a time, so that a slow endpoint does not hold up the others.
+func (app *application) deliverWebhooks(ctx context.Context) error {
+	concurrency := app.config.webhooks.concurrency
+
+	for {
+		deliveries, err := app.models.WebhookDeliveries.Claim(ctx, concurrency, deliveryLease)
+		if err != nil {
+			return err
+		}
+
+		var wg sync.WaitGroup
+		errs := make([]error, len(deliveries))
+
+		for i, delivery := range deliveries {
+			wg.Add(1)
+			go func(i int, delivery *models.WebhookDelivery) {
+				defer wg.Done()
+				errs[i] = app.deliverWebhook(ctx, delivery)
+			}(i, delivery)
+		}
+
+		wg.Wait()
+
+		err = errors.Join(errs...)
+		if err != nil {
+			return err
+		}
+
+		if len(deliveries) < concurrency {
+			return nil
+		}
+	}
+}
+
+func (app *application) deliverWebhook(ctx context.Context, delivery *models.WebhookDelivery) error {
+	status, err := app.webhooks.Send(ctx, delivery.URL, delivery.Secret, delivery.Event, delivery.ID, delivery.Payload)
+	if err == nil {
+		return app.models.WebhookDeliveries.MarkDelivered(ctx, delivery.ID, status)
+	}
+
+	properties := map[string]string{
+		"worker":      "webhook deliveries",
+		"webhook_id":  strconv.FormatInt(delivery.WebhookID, 10),
+		"delivery_id": strconv.FormatInt(delivery.ID, 10),
+		"attempts":    strconv.Itoa(delivery.Attempts),
+	}
+
+	if delivery.Attempts >= app.config.webhooks.maxAttempts {
+		app.logger.PrintInfo("webhook delivery failed, giving up", properties)
+		return app.models.WebhookDeliveries.MarkDead(ctx, delivery.ID, status, err.Error())
+	}
+
+	app.logger.PrintInfo("webhook delivery failed, retrying", properties)
+	return app.models.WebhookDeliveries.MarkFailed(ctx, delivery.ID, status, err.Error(), time.Now().Add(backoff(delivery.Attempts)))
+}
@@ -1,11 +1,15 @@
 package main
 
 import (
+	"encoding/json"
 	"errors"
+	"maps"
+	"mime"
 	"net/http"
 	"strconv"
 
 	"github.com/Li-Elias/Railclone/internal/deployments"
+	"github.com/Li-Elias/Railclone/internal/i18n"
 	"github.com/Li-Elias/Railclone/internal/models"
 	"github.com/Li-Elias/Railclone/internal/validator"
 	"github.com/go-chi/chi/v5"
@@ -59,43 +63,62 @@ func (app *application) createDeploymentHandler(w http.ResponseWriter, r *http.R
 		return
 	}
 
-	err = app.models.Deployments.Insert(deployment)
+	err = app.deployments.Create(r.Context(), deployment)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	deployment.Port, err = deployments.Create(app.clientset, deployment)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(deployment.Version))
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"deployment": deployment}, headers)
 	if err != nil {
-		// delete postgres entry because object does not exist anymore
-		app.models.Deployments.DeleteFromUser(deployment.ID, user.ID)
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	// Insert port
-	deployment, err = app.models.Deployments.UpdateFromUser(deployment.ID, user.ID, deployment)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-		return
+func (app *application) getUserDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		models.DeploymentFilter
+		models.Filters
 	}
 
-	err = app.writeJSON(w, http.StatusCreated, envelope{"deployment": deployment}, nil)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
+	v := validator.New()
+
+	qs := r.URL.Query()
+
+	input.Image = app.readString(qs, "image", "")
+	input.Running = app.readBool(qs, "running", v)
+	input.Search = app.readString(qs, "q", "")
+
+	input.Filters.Page = app.readInt(qs, "page", 1, v)
+	input.Filters.PageSize = app.readInt(qs, "page_size", 20, v)
+	input.Filters.Sort = app.readString(qs, "sort", "-created_at")
+	input.Filters.SortSafelist = []string{
+		"created_at", "last_updated", "image",
+		"-created_at", "-last_updated", "-image",
+	}
+
+	if models.ValidateFilters(v, input.Filters); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
 	}
-}
 
-func (app *application) getUserDeploymentsHandler(w http.ResponseWriter, r *http.Request) {
 	user := app.contextGetUser(r)
 
-	deployments, err := app.models.Deployments.GetAllFromUser(user.ID)
+	deployments, metadata, err := app.models.Deployments.GetAllFromUser(r.Context(), user.ID, input.DeploymentFilter, input.Filters)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"deployments": deployments}, nil)
+	headers := make(http.Header)
+	if links := app.paginationLinks(r, metadata); links != "" {
+		headers.Set("Link", links)
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deployments": deployments, "metadata": metadata}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -111,7 +134,7 @@ func (app *application) getUserDeploymentHandler(w http.ResponseWriter, r *http.
 
 	user := app.contextGetUser(r)
 
-	deployment, err := app.models.Deployments.GetFromUser(id, user.ID)
+	deployment, err := app.models.Deployments.GetFromUser(r.Context(), id, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
@@ -122,7 +145,10 @@ func (app *application) getUserDeploymentHandler(w http.ResponseWriter, r *http.
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"deployment": deployment}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(deployment.Version))
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"deployment": deployment}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -152,8 +178,20 @@ func (app *application) updateUserDeploymentHandler(w http.ResponseWriter, r *ht
 
 	user := app.contextGetUser(r)
 
+	deployment, err := app.models.Deployments.GetFromUser(r.Context(), id, user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			app.notFoundResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
 	updatedDeployment := &models.Deployment{
 		ID:       id,
+		Image:    deployment.Image,
 		Port:     input.Port,
 		Volume:   input.Volume,
 		Replicas: input.Replicas,
@@ -161,8 +199,58 @@ func (app *application) updateUserDeploymentHandler(w http.ResponseWriter, r *ht
 		UserID:   user.ID,
 		Running:  input.Running,
 	}
+	if updatedDeployment.Port == 0 {
+		updatedDeployment.Port = deployment.Port
+	}
+
+	app.updateDeployment(w, r, deployment, updatedDeployment)
+}
+
+func (app *application) patchUserDeploymentHandler(w http.ResponseWriter, r *http.Request) {
+	id_str := chi.URLParam(r, "id")
+	id, err := strconv.ParseInt(id_str, 10, 64)
+	if err != nil || id < 1 {
+		app.notFoundResponse(w, r)
+		return
+	}
+
+	mediaType, _, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "application/merge-patch+json" {
+		app.unsupportedMediaTypeResponse(w, r, "application/merge-patch+json")
+		return
+	}
+
+	// pointers tell fields that were left out apart from zero values, and a
+	// null env var removes it as described in RFC 7396, as does a null
+	// env_vars with all of them
+	var input struct {
+		Port     *int32          `json:"port"`
+		Volume   *int32          `json:"volume"`
+		Replicas *int32          `json:"replicas"`
+		EnvVars  json.RawMessage `json:"env_vars"`
+		Running  *bool           `json:"running"`
+	}
+
+	err = app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	clearEnvVars := string(input.EnvVars) == "null"
+
+	var envVars map[string]*string
+	if input.EnvVars != nil && !clearEnvVars {
+		err = json.Unmarshal(input.EnvVars, &envVars)
+		if err != nil {
+			app.badRequestResponse(w, r, i18n.Messagef("body contains incorrect JSON type for field %q", "env_vars"))
+			return
+		}
+	}
 
-	deployment, err := app.models.Deployments.GetFromUser(id, user.ID)
+	user := app.contextGetUser(r)
+
+	deployment, err := app.models.Deployments.GetFromUser(r.Context(), id, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
@@ -173,10 +261,53 @@ func (app *application) updateUserDeploymentHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	updatedDeployment.Image = deployment.Image
+	updatedDeployment := *deployment
+	updatedDeployment.EnvVars = maps.Clone(deployment.EnvVars)
+
+	if input.Port != nil {
+		updatedDeployment.Port = *input.Port
+	}
+	if input.Volume != nil {
+		updatedDeployment.Volume = *input.Volume
+	}
+	if input.Replicas != nil {
+		updatedDeployment.Replicas = *input.Replicas
+	}
+	if input.Running != nil {
+		updatedDeployment.Running = *input.Running
+	}
+	if clearEnvVars {
+		updatedDeployment.EnvVars = nil
+	}
+	for key, value := range envVars {
+		if value == nil {
+			delete(updatedDeployment.EnvVars, key)
+			continue
+		}
+		if updatedDeployment.EnvVars == nil {
+			updatedDeployment.EnvVars = make(map[string]string)
+		}
+		updatedDeployment.EnvVars[key] = *value
+	}
+
+	app.updateDeployment(w, r, deployment, &updatedDeployment)
+}
+
+func (app *application) updateDeployment(w http.ResponseWriter, r *http.Request, deployment, updatedDeployment *models.Deployment) {
+	match, err := app.ifMatch(r, deployment.Version)
+	if err != nil {
+		app.preconditionRequiredResponse(w, r)
+		return
+	}
+	if !match {
+		app.preconditionFailedResponse(w, r)
+		return
+	}
 
 	v := validator.New()
 	models.ValidateDeployment(v, updatedDeployment)
+	// only the size of an existing volume can be changed
+	v.Check((deployment.Volume == 0) == (updatedDeployment.Volume == 0), "volume", "cannot be added to or removed from an existing deployment")
 	if updatedDeployment.Port != 0 {
 		v.Check(updatedDeployment.Port >= 30000, "port", "cannot have a value under 30000")
 		v.Check(updatedDeployment.Port <= 32767, "port", "cannot have a value over 32767")
@@ -186,23 +317,23 @@ func (app *application) updateUserDeploymentHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err = deployments.Update(app.clientset, deployment, updatedDeployment)
-	if err != nil {
-		app.serverErrorResponse(w, r, err)
-	}
-
-	updatedDeployment, err = app.models.Deployments.UpdateFromUser(id, user.ID, updatedDeployment)
+	updatedDeployment, err = app.deployments.Update(r.Context(), deployment, updatedDeployment)
 	if err != nil {
 		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.notFoundResponse(w, r)
+		case errors.Is(err, models.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		case errors.Is(err, deployments.ErrDeletionPending):
+			app.deletionPendingResponse(w, r)
 		default:
 			app.serverErrorResponse(w, r, err)
 		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"deployment": updatedDeployment}, nil)
+	headers := make(http.Header)
+	headers.Set("ETag", etag(updatedDeployment.Version))
+
+	err = app.writeJSON(w, http.StatusAccepted, envelope{"deployment": updatedDeployment}, headers)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -218,7 +349,7 @@ func (app *application) deleteUserDeploymentHandler(w http.ResponseWriter, r *ht
 
 	user := app.contextGetUser(r)
 
-	err = app.models.Deployments.DeleteFromUser(id, user.ID)
+	deployment, err := app.models.Deployments.GetFromUser(r.Context(), id, user.ID)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
@@ -229,13 +360,30 @@ func (app *application) deleteUserDeploymentHandler(w http.ResponseWriter, r *ht
 		return
 	}
 
-	err = deployments.Delete(app.clientset, id, user.ID)
+	app.deleteDeployment(w, r, deployment)
+}
+
+func (app *application) deleteDeployment(w http.ResponseWriter, r *http.Request, deployment *models.Deployment) {
+	err := app.deployments.Delete(r.Context(), deployment)
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		// once the deployment is marked as deleting the sweeper takes
+		// care of whatever is left in the cluster
+		if deployment.Status != models.StatusDeleting {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if !errors.Is(err, deployments.ErrDeletionPending) {
+			app.logError(r, err)
+		}
+
+		err = app.writeJSON(w, http.StatusAccepted, envelope{"message": i18n.T(app.locale(r), "deployment deletion is in progress")}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "deployment successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": i18n.T(app.locale(r), "deployment successfully deleted")}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -1,77 +1,248 @@
 package main
 
 import (
-	"fmt"
+	"context"
+	"errors"
+	"mime"
 	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/go-chi/chi/v5/middleware"
 )
 
 func (app *application) logError(r *http.Request, err error) {
 	app.logger.PrintError(err, map[string]string{
+		"request_id":     middleware.GetReqID(r.Context()),
 		"request_method": r.Method,
 		"request_url":    r.URL.String(),
 	})
 }
 
-func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, message interface{}) {
-	env := envelope{"error": message}
-	err := app.writeJSON(w, status, env, nil)
+// errorResponse sends an RFC 7807 problem with a stable code, or the
+// {"error": message} envelope of old clients that prefer application/json.
+// The message, or every message of a validation error map, is translated into
+// the locale of the request.
+func (app *application) errorResponse(w http.ResponseWriter, r *http.Request, status int, code string, message interface{}) {
+	locale := app.locale(r)
+
+	switch m := message.(type) {
+	case string:
+		message = i18n.T(locale, m)
+	case *i18n.Message:
+		message = m.Translate(locale)
+	case map[string]string:
+		translated := make(map[string]string, len(m))
+		for key, value := range m {
+			translated[key] = i18n.T(locale, value)
+		}
+		message = translated
+	}
+
+	headers := make(http.Header)
+	headers.Set("Content-Language", locale)
+	headers.Set("Vary", "Accept")
+
+	var env envelope
+	if prefersLegacyErrors(r) {
+		env = envelope{"error": message}
+	} else {
+		headers.Set("Content-Type", "application/problem+json")
+
+		env = envelope{
+			"type":   "urn:railclone:problem:" + code,
+			"title":  http.StatusText(status),
+			"status": status,
+			"code":   code,
+		}
+
+		if id := middleware.GetReqID(r.Context()); id != "" {
+			env["instance"] = id
+		}
+
+		switch m := message.(type) {
+		case map[string]string:
+			env["detail"] = i18n.T(locale, "one or more fields are invalid")
+			env["errors"] = fieldErrors(m)
+		default:
+			env["detail"] = m
+		}
+	}
+
+	err := app.writeJSON(w, status, env, headers)
 	if err != nil {
 		app.logError(r, err)
 		w.WriteHeader(500)
 	}
 }
 
+type fieldError struct {
+	Field  string `json:"field"`
+	Detail string `json:"detail"`
+}
+
+func fieldErrors(errors map[string]string) []fieldError {
+	fields := make([]fieldError, 0, len(errors))
+	for field, detail := range errors {
+		fields = append(fields, fieldError{Field: field, Detail: detail})
+	}
+
+	sort.Slice(fields, func(i, j int) bool {
+		return fields[i].Field < fields[j].Field
+	})
+
+	return fields
+}
+
+// prefersLegacyErrors reports whether the Accept header asks for
+// application/json and not at least as much for application/problem+json.
+// Clients that accept anything get problems.
+func prefersLegacyErrors(r *http.Request) bool {
+	var jsonQ, problemQ float64 = -1, -1
+
+	for _, accept := range strings.Split(r.Header.Get("Accept"), ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(accept))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		switch mediaType {
+		case "application/json":
+			jsonQ = max(jsonQ, q)
+		case "application/problem+json":
+			problemQ = max(problemQ, q)
+		}
+	}
+
+	return jsonQ > 0 && jsonQ > problemQ
+}
+
 func (app *application) serverErrorResponse(w http.ResponseWriter, r *http.Request, err error) {
+	switch {
+	case errors.Is(err, models.ErrCanceled), errors.Is(err, context.Canceled):
+		// the client has gone away, so there is nobody left to respond to
+		return
+	case errors.Is(err, models.ErrTimeout), errors.Is(err, context.DeadlineExceeded):
+		app.timeoutResponse(w, r)
+		return
+	}
+
 	app.logError(r, err)
 	message := "the server encountered a problem and could not process your request"
-	app.errorResponse(w, r, http.StatusInternalServerError, message)
+	app.errorResponse(w, r, http.StatusInternalServerError, "server_error", message)
+}
+
+func (app *application) timeoutResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the server took too long to process your request, please try again"
+	app.errorResponse(w, r, http.StatusServiceUnavailable, "timeout", message)
 }
 
 func (app *application) notFoundResponse(w http.ResponseWriter, r *http.Request) {
 	message := "the requested resource could not be found"
-	app.errorResponse(w, r, http.StatusNotFound, message)
+	app.errorResponse(w, r, http.StatusNotFound, "not_found", message)
 }
 
 func (app *application) methodNotAllowedResponse(w http.ResponseWriter, r *http.Request) {
-	message := fmt.Sprintf("the %s method is not supported for this resource", r.Method)
-	app.errorResponse(w, r, http.StatusMethodNotAllowed, message)
+	message := i18n.Messagef("the %s method is not supported for this resource", r.Method)
+	app.errorResponse(w, r, http.StatusMethodNotAllowed, "method_not_allowed", message)
 }
 
 func (app *application) badRequestResponse(w http.ResponseWriter, r *http.Request, err error) {
-	app.errorResponse(w, r, http.StatusBadRequest, err.Error())
+	var message *i18n.Message
+	if errors.As(err, &message) {
+		app.errorResponse(w, r, http.StatusBadRequest, "bad_request", message)
+		return
+	}
+	app.errorResponse(w, r, http.StatusBadRequest, "bad_request", err.Error())
 }
 
 func (app *application) failedValidationResponse(w http.ResponseWriter, r *http.Request, errors map[string]string) {
-	app.errorResponse(w, r, http.StatusUnprocessableEntity, errors)
+	app.errorResponse(w, r, http.StatusUnprocessableEntity, "failed_validation", errors)
 }
 
 func (app *application) invalidCredentialsResponse(w http.ResponseWriter, r *http.Request) {
 	message := "invalid authentication credentials"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_credentials", message)
 }
 
 func (app *application) invalidAuthenticationTokenResponse(w http.ResponseWriter, r *http.Request) {
 	w.Header().Set("WWW-Authenticate", "Bearer")
 	message := "invalid or missing authentication token"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "invalid_authentication_token", message)
 }
 
 func (app *application) authenticationRequiredResponse(w http.ResponseWriter, r *http.Request) {
 	message := "you must be authenticated to access this resource"
-	app.errorResponse(w, r, http.StatusUnauthorized, message)
+	app.errorResponse(w, r, http.StatusUnauthorized, "authentication_required", message)
 }
 
 func (app *application) editConflictResponse(w http.ResponseWriter, r *http.Request) {
 	message := "unable to update the record due to an edit conflict, please try again"
-	app.errorResponse(w, r, http.StatusConflict, message)
+	app.errorResponse(w, r, http.StatusConflict, "edit_conflict", message)
+}
+
+func (app *application) deletionPendingResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the deployment is being deleted and can no longer be updated"
+	app.errorResponse(w, r, http.StatusConflict, "deletion_pending", message)
+}
+
+func (app *application) preconditionFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the resource has been modified since you last fetched it"
+	app.errorResponse(w, r, http.StatusPreconditionFailed, "precondition_failed", message)
+}
+
+func (app *application) preconditionRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request must include an If-Match header with the resource's ETag"
+	app.errorResponse(w, r, http.StatusPreconditionRequired, "precondition_required", message)
+}
+
+func (app *application) unsupportedMediaTypeResponse(w http.ResponseWriter, r *http.Request, mediaType string) {
+	message := i18n.Messagef("the request body must be of type %s", mediaType)
+	app.errorResponse(w, r, http.StatusUnsupportedMediaType, "unsupported_media_type", message)
 }
 
 func (app *application) inactiveAccountResponse(w http.ResponseWriter, r *http.Request) {
 	message := "your user account must be activated to access this resource"
-	app.errorResponse(w, r, http.StatusForbidden, message)
+	app.errorResponse(w, r, http.StatusForbidden, "inactive_account", message)
+}
+
+func (app *application) unverifiedEmailResponse(w http.ResponseWriter, r *http.Request) {
+	message := "the identity provider has not verified your email address"
+	app.errorResponse(w, r, http.StatusForbidden, "unverified_email", message)
+}
+
+func (app *application) secondFactorRequiredResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this action requires a valid two-factor code in the X-TOTP-Code header"
+	app.errorResponse(w, r, http.StatusForbidden, "second_factor_required", message)
+}
+
+func (app *application) accountSuspendedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account has been suspended"
+	app.errorResponse(w, r, http.StatusForbidden, "account_suspended", message)
+}
+
+func (app *application) notPermittedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "your user account doesn't have the necessary permissions to access this resource"
+	app.errorResponse(w, r, http.StatusForbidden, "not_permitted", message)
+}
+
+func (app *application) challengeFailedResponse(w http.ResponseWriter, r *http.Request) {
+	message := "this request requires a solved challenge"
+	app.errorResponse(w, r, http.StatusForbidden, "challenge_failed", message)
 }
 
 func (app *application) tooManyRequests(w http.ResponseWriter, r *http.Request) {
 	message := "too many requests"
-	app.errorResponse(w, r, http.StatusTooManyRequests, message)
+	app.errorResponse(w, r, http.StatusTooManyRequests, "rate_limited", message)
 }
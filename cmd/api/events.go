@@ -0,0 +1,369 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+const (
+	eventsBatchSize    = 100
+	eventsReplayLimit  = 10000
+	eventsBuffer       = 64
+	eventsPublished    = 4096
+	eventsLookBack     = 1000
+	eventsRetention    = 24 * time.Hour
+	eventsPingInterval = time.Minute
+	eventsHeartbeat    = 15 * time.Second
+	eventsWriteTimeout = 10 * time.Second
+)
+
+// eventHub fans the deployment events out to the streams of their users.
+// It remembers the IDs of the last eventsPublished events, so that an event
+// that is both caught up on and notified about is only published once.
+type eventHub struct {
+	mu        sync.Mutex
+	streams   map[int64]map[chan *models.DeploymentEvent]bool
+	published map[int64]bool
+	order     []int64
+	closed    bool
+}
+
+func newEventHub() *eventHub {
+	return &eventHub{
+		streams:   make(map[int64]map[chan *models.DeploymentEvent]bool),
+		published: make(map[int64]bool, eventsPublished),
+		order:     make([]int64, 0, eventsPublished),
+	}
+}
+
+// subscribe returns a channel with the events of a user. It is closed when
+// the stream falls too far behind, and when the server shuts down.
+func (h *eventHub) subscribe(userID int64) chan *models.DeploymentEvent {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	ch := make(chan *models.DeploymentEvent, eventsBuffer)
+	if h.closed {
+		close(ch)
+		return ch
+	}
+
+	if h.streams[userID] == nil {
+		h.streams[userID] = make(map[chan *models.DeploymentEvent]bool)
+	}
+	h.streams[userID][ch] = true
+
+	return ch
+}
+
+func (h *eventHub) unsubscribe(userID int64, ch chan *models.DeploymentEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.remove(userID, ch)
+}
+
+func (h *eventHub) remove(userID int64, ch chan *models.DeploymentEvent) {
+	if !h.streams[userID][ch] {
+		return
+	}
+
+	delete(h.streams[userID], ch)
+	if len(h.streams[userID]) == 0 {
+		delete(h.streams, userID)
+	}
+	close(ch)
+}
+
+// publish never blocks. A stream whose buffer is full is closed instead, and
+// its client resumes from the Last-Event-ID it has seen. Events that have
+// been published already are dropped.
+func (h *eventHub) publish(event *models.DeploymentEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	if h.published[event.ID] {
+		return
+	}
+	if len(h.order) == eventsPublished {
+		delete(h.published, h.order[0])
+		h.order = h.order[1:]
+	}
+	h.published[event.ID] = true
+	h.order = append(h.order, event.ID)
+
+	for ch := range h.streams[event.UserID] {
+		select {
+		case ch <- event:
+		default:
+			h.remove(event.UserID, ch)
+		}
+	}
+}
+
+func (h *eventHub) close() {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	h.closed = true
+	for userID, streams := range h.streams {
+		for ch := range streams {
+			h.remove(userID, ch)
+		}
+	}
+}
+
+// runEventListener publishes the deployment events Postgres notifies about,
+// and removes the events that are too old to resume from.
+func (app *application) runEventListener(ctx context.Context) {
+	properties := map[string]string{
+		"worker": "deployment events",
+	}
+
+	listener := pq.NewListener(app.config.DB.Dsn, time.Second, time.Minute, func(event pq.ListenerEventType, err error) {
+		if err != nil {
+			app.logger.PrintError(err, properties)
+		}
+	})
+	defer listener.Close()
+
+	err := listener.Listen(models.DeploymentEventsChannel)
+	if err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+
+	lastID, err := app.models.DeploymentEvents.LatestID(ctx)
+	if err != nil {
+		app.logger.PrintError(err, properties)
+		return
+	}
+
+	ticker := time.NewTicker(eventsPingInterval)
+	defer ticker.Stop()
+
+	for {
+		afterID := lastID
+
+		select {
+		case <-ctx.Done():
+			return
+
+		case n := <-listener.Notify:
+			// a nil notification means the connection was reestablished and
+			// notifications may have been missed. Events committed after ones
+			// with greater IDs are only found by looking back from lastID;
+			// the hub drops the ones that have been published already.
+			if n == nil {
+				afterID = max(lastID-eventsLookBack, 0)
+				break
+			}
+
+			id, err := strconv.ParseInt(n.Extra, 10, 64)
+			if err == nil && id <= lastID {
+				// committed after events with greater IDs
+				err = app.publishEvent(ctx, id)
+			}
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+
+		case <-ticker.C:
+			err := listener.Ping()
+			if err != nil {
+				app.logger.PrintError(err, properties)
+			}
+
+			err = app.models.DeploymentEvents.DeleteOlderThan(ctx, time.Now().Add(-eventsRetention))
+			if err != nil && !errors.Is(err, models.ErrCanceled) {
+				app.logger.PrintError(err, properties)
+			}
+		}
+
+		id, err := app.publishEvents(ctx, afterID)
+		if err != nil && !errors.Is(err, models.ErrCanceled) {
+			app.logger.PrintError(err, properties)
+		}
+		lastID = max(lastID, id)
+	}
+}
+
+// publishEvents publishes every event after lastID and returns the ID of the
+// last one.
+func (app *application) publishEvents(ctx context.Context, lastID int64) (int64, error) {
+	for {
+		events, err := app.models.DeploymentEvents.GetAllAfter(ctx, 0, lastID, eventsBatchSize)
+		if err != nil {
+			return lastID, err
+		}
+
+		for _, event := range events {
+			app.events.publish(event)
+			lastID = event.ID
+		}
+
+		if len(events) < eventsBatchSize {
+			return lastID, nil
+		}
+	}
+}
+
+func (app *application) publishEvent(ctx context.Context, id int64) error {
+	event, err := app.models.DeploymentEvents.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	app.events.publish(event)
+	return nil
+}
+
+// deploymentEventsHandler streams the deployment events of the user as
+// Server-Sent Events. A client that reconnects with the Last-Event-ID header
+// first gets the events it missed, as long as they are not older than
+// eventsRetention. A client that missed more than eventsReplayLimit events
+// gets a reset event instead, and has to fetch its deployments again.
+func (app *application) deploymentEventsHandler(w http.ResponseWriter, r *http.Request) {
+	var lastID int64
+	resume := r.Header.Get("Last-Event-ID")
+	if resume != "" {
+		var err error
+		lastID, err = strconv.ParseInt(resume, 10, 64)
+		if err != nil || lastID < 0 {
+			app.badRequestResponse(w, r, errors.New("invalid Last-Event-ID header"))
+			return
+		}
+	}
+
+	user := app.contextGetUser(r)
+
+	// subscribe before reading the missed events, so that nothing falls in
+	// between
+	events := app.events.subscribe(user.ID)
+	defer app.events.unsubscribe(user.ID, events)
+
+	var missed int
+	var resetID int64
+	if resume != "" {
+		var err error
+		missed, err = app.models.DeploymentEvents.CountAfter(r.Context(), user.ID, lastID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if missed > eventsReplayLimit {
+			resetID, err = app.models.DeploymentEvents.LatestID(r.Context())
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+		}
+	}
+
+	rc := http.NewResponseController(w)
+
+	// the server's write timeout would end the stream, so every write gets
+	// its own deadline instead
+	send := func(format string, args ...interface{}) error {
+		err := rc.SetWriteDeadline(time.Now().Add(eventsWriteTimeout))
+		if err != nil && !errors.Is(err, http.ErrNotSupported) {
+			return err
+		}
+
+		_, err = fmt.Fprintf(w, format, args...)
+		if err != nil {
+			return err
+		}
+
+		return rc.Flush()
+	}
+
+	sendEvent := func(event *models.DeploymentEvent) error {
+		return send("id: %d\nevent: %s\ndata: %s\n\n", event.ID, event.Type, event.Data)
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	err := send("retry: %d\n\n", (3 * time.Second).Milliseconds())
+	if err != nil {
+		return
+	}
+
+	sent := make(map[int64]bool)
+
+	switch {
+	case resetID != 0:
+		// the reset event moves the Last-Event-ID of the client past the
+		// events it skips
+		err := send("id: %d\nevent: reset\ndata: {\"missed\":%d}\n\n", resetID, missed)
+		if err != nil {
+			return
+		}
+
+	case missed != 0:
+		for {
+			page, err := app.models.DeploymentEvents.GetAllAfter(r.Context(), user.ID, lastID, eventsBatchSize)
+			if err != nil {
+				if !errors.Is(err, models.ErrCanceled) {
+					app.logger.PrintError(err, nil)
+				}
+				return
+			}
+
+			for _, event := range page {
+				err := sendEvent(event)
+				if err != nil {
+					return
+				}
+				sent[event.ID] = true
+				lastID = event.ID
+			}
+
+			if len(page) < eventsBatchSize {
+				break
+			}
+		}
+	}
+
+	heartbeat := time.NewTicker(eventsHeartbeat)
+	defer heartbeat.Stop()
+
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+
+		case event, ok := <-events:
+			if !ok {
+				return
+			}
+			if sent[event.ID] {
+				continue
+			}
+
+			err := sendEvent(event)
+			if err != nil {
+				return
+			}
+
+		case <-heartbeat.C:
+			err := send(": heartbeat\n\n")
+			if err != nil {
+				return
+			}
+		}
+	}
+}
@@ -1,15 +1,54 @@
 package main
 
 import (
+	"context"
+	"net"
 	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/mail"
+)
+
+// version and commit are set at build time with
+// -ldflags="-X main.version=... -X main.commit=...".
+var (
+	version = "dev"
+	commit  = "unknown"
+)
+
+const (
+	readinessTimeout  = 2 * time.Second
+	readinessCacheTTL = time.Second
 )
 
+// readinessCache keeps the results of the last readiness checks for
+// readinessCacheTTL, so that frequent probes do not load the dependencies.
+type readinessCache struct {
+	mu      sync.Mutex
+	checked time.Time
+	ready   bool
+	results map[string]dependencyStatus
+}
+
+type dependencyStatus struct {
+	Status    string  `json:"status"`
+	LatencyMS float64 `json:"latency_ms"`
+}
+
+func (app *application) systemInfo() map[string]string {
+	return map[string]string{
+		"environment": app.config.env,
+		"version":     version,
+		"commit":      commit,
+	}
+}
+
 func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Request) {
 	env := envelope{
-		"status": "available",
-		"system_info": map[string]string{
-			"environment": app.config.env,
-		},
+		"status":      "available",
+		"system_info": app.systemInfo(),
 	}
 
 	err := app.writeJSON(w, http.StatusOK, env, nil)
@@ -17,3 +56,138 @@ func (app *application) healthcheckHandler(w http.ResponseWriter, r *http.Reques
 		app.serverErrorResponse(w, r, err)
 	}
 }
+
+// livezHandler only reports that the process is able to serve requests.
+func (app *application) livezHandler(w http.ResponseWriter, r *http.Request) {
+	err := app.writeJSON(w, http.StatusOK, envelope{"status": "alive"}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// readyzHandler checks every dependency the API needs to serve requests and
+// responds with 503 if one of them is down or the server is shutting down.
+// Only whether a dependency is up is reported; the errors are logged.
+func (app *application) readyzHandler(w http.ResponseWriter, r *http.Request) {
+	if app.shuttingDown.Load() {
+		env := envelope{
+			"status":      "shutting down",
+			"system_info": app.systemInfo(),
+		}
+
+		err := app.writeJSON(w, http.StatusServiceUnavailable, env, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	ready, results := app.checkReadiness(r.Context())
+
+	status, code := "ready", http.StatusOK
+	if !ready {
+		status, code = "unavailable", http.StatusServiceUnavailable
+	}
+
+	env := envelope{
+		"status":       status,
+		"system_info":  app.systemInfo(),
+		"dependencies": results,
+	}
+
+	err := app.writeJSON(w, code, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// checkReadiness runs the readiness checks, or returns the results of the
+// last ones if they are recent enough. Concurrent probes wait for the same
+// checks.
+func (app *application) checkReadiness(ctx context.Context) (bool, map[string]dependencyStatus) {
+	app.readiness.mu.Lock()
+	defer app.readiness.mu.Unlock()
+
+	if time.Since(app.readiness.checked) < readinessCacheTTL {
+		return app.readiness.ready, app.readiness.results
+	}
+
+	checks := map[string]func(ctx context.Context) error{
+		"database": app.db.PingContext,
+		"kubernetes": func(ctx context.Context) error {
+			return app.clientset.Discovery().RESTClient().Get().AbsPath("/version").Do(ctx).Error()
+		},
+	}
+	if app.redis != nil {
+		checks["redis"] = func(ctx context.Context) error {
+			return app.redis.Ping(ctx).Err()
+		}
+	}
+	if app.config.readyzSMTP && app.config.mail.Transport == mail.TransportSMTP {
+		checks["smtp"] = app.pingSMTP
+	}
+
+	// the results are shared with other probes, so the one that runs the
+	// checks going away must not fail them
+	ctx = context.WithoutCancel(ctx)
+
+	var mu sync.Mutex
+	var wg sync.WaitGroup
+	results := make(map[string]dependencyStatus, len(checks))
+	ready := true
+
+	for name, check := range checks {
+		wg.Add(1)
+
+		go func(name string, check func(ctx context.Context) error) {
+			defer wg.Done()
+
+			ctx, cancel := context.WithTimeout(ctx, readinessTimeout)
+			defer cancel()
+
+			start := time.Now()
+			err := check(ctx)
+
+			result := dependencyStatus{
+				Status:    "up",
+				LatencyMS: float64(time.Since(start).Microseconds()) / 1000,
+			}
+			if err != nil {
+				result.Status = "down"
+				app.logger.PrintError(err, map[string]string{
+					"dependency": name,
+					"latency_ms": strconv.FormatFloat(result.LatencyMS, 'f', -1, 64),
+				})
+			}
+
+			mu.Lock()
+			defer mu.Unlock()
+
+			results[name] = result
+			if err != nil {
+				ready = false
+			}
+		}(name, check)
+	}
+
+	wg.Wait()
+
+	app.readiness.checked = time.Now()
+	app.readiness.ready = ready
+	app.readiness.results = results
+
+	return ready, results
+}
+
+// pingSMTP only connects to the SMTP server, it does not authenticate.
+func (app *application) pingSMTP(ctx context.Context) error {
+	addr := net.JoinHostPort(app.config.mail.SMTP.Host, strconv.Itoa(app.config.mail.SMTP.Port))
+
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, "tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	return conn.Close()
+}
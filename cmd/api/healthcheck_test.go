@@ -0,0 +1,81 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestReadyzResponse(t *testing.T) {
+	app := &application{}
+
+	// recent results are served from the cache, so no dependency is checked
+	app.readiness.checked = time.Now()
+	app.readiness.ready = false
+	app.readiness.results = map[string]dependencyStatus{
+		"database":   {Status: "up", LatencyMS: 1.5},
+		"kubernetes": {Status: "down", LatencyMS: 2000},
+	}
+
+	rr := httptest.NewRecorder()
+	app.readyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Status       string                     `json:"status"`
+		SystemInfo   map[string]string          `json:"system_info"`
+		Dependencies map[string]json.RawMessage `json:"dependencies"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if body.Status != "unavailable" {
+		t.Errorf("got status %q; want %q", body.Status, "unavailable")
+	}
+	if body.SystemInfo["version"] == "" {
+		t.Error("got no version in system_info")
+	}
+
+	want := map[string]string{
+		"database":   `{"status":"up","latency_ms":1.5}`,
+		"kubernetes": `{"status":"down","latency_ms":2000}`,
+	}
+	if len(body.Dependencies) != len(want) {
+		t.Errorf("got dependencies %v; want %v", body.Dependencies, want)
+	}
+	for name, dependency := range want {
+		if string(body.Dependencies[name]) != dependency {
+			t.Errorf("got %s for %s; want %s", body.Dependencies[name], name, dependency)
+		}
+	}
+}
+
+func TestReadyzShuttingDown(t *testing.T) {
+	app := &application{}
+	app.shuttingDown.Store(true)
+
+	rr := httptest.NewRecorder()
+	app.readyzHandler(rr, httptest.NewRequest(http.MethodGet, "/readyz", nil))
+
+	if rr.Code != http.StatusServiceUnavailable {
+		t.Errorf("got status %d; want %d", rr.Code, http.StatusServiceUnavailable)
+	}
+
+	var body struct {
+		Status string `json:"status"`
+	}
+	err := json.Unmarshal(rr.Body.Bytes(), &body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if body.Status != "shutting down" {
+		t.Errorf("got status %q; want %q", body.Status, "shutting down")
+	}
+}
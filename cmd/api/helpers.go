@@ -5,8 +5,16 @@ import (
 	"errors"
 	"fmt"
 	"io"
+	"net"
 	"net/http"
+	"net/url"
+	"strconv"
 	"strings"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/mail"
+	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/Li-Elias/Railclone/internal/validator"
 )
 
 type envelope map[string]interface{}
@@ -20,10 +28,12 @@ func (app *application) writeJSON(w http.ResponseWriter, status int, data envelo
 	js = append(js, '\n')
 
 	for key, value := range headers {
-		w.Header()[key] = value
+		w.Header()[key] = append(w.Header()[key], value...)
 	}
 
-	w.Header().Set("Content-Type", "application/json")
+	if headers.Get("Content-Type") == "" {
+		w.Header().Set("Content-Type", "application/json")
+	}
 	w.WriteHeader(status)
 	w.Write(js)
 	return nil
@@ -44,7 +54,7 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 		switch {
 		case errors.As(err, &syntaxError):
-			return fmt.Errorf(
+			return i18n.Messagef(
 				"body contains badly-formed JSON (at character %d)",
 				syntaxError.Offset,
 			)
@@ -54,12 +64,12 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 		case errors.As(err, &unmarshalTypeError):
 			if unmarshalTypeError.Field != "" {
-				return fmt.Errorf(
+				return i18n.Messagef(
 					"body contains incorrect JSON type for field %q",
 					unmarshalTypeError.Field,
 				)
 			}
-			return fmt.Errorf(
+			return i18n.Messagef(
 				"body contains incorrect JSON type (at character %d)",
 				unmarshalTypeError.Offset,
 			)
@@ -69,10 +79,10 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 
 		case strings.HasPrefix(err.Error(), "json: unknown field "):
 			fieldName := strings.TrimPrefix(err.Error(), "json: unknown field ")
-			return fmt.Errorf("body contains unknown key %s", fieldName)
+			return i18n.Messagef("body contains unknown key %s", fieldName)
 
 		case err.Error() == "http: request body too large":
-			return fmt.Errorf("body must not be larger than %d bytes", maxBytes)
+			return i18n.Messagef("body must not be larger than %d bytes", maxBytes)
 
 		case errors.As(err, &invalidUnmarshalError):
 			panic(err)
@@ -90,6 +100,95 @@ func (app *application) readJSON(w http.ResponseWriter, r *http.Request, dst int
 	return nil
 }
 
+func (app *application) readString(qs url.Values, key string, defaultValue string) string {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+	return s
+}
+
+func (app *application) readInt(qs url.Values, key string, defaultValue int, v *validator.Validator) int {
+	s := qs.Get(key)
+	if s == "" {
+		return defaultValue
+	}
+
+	i, err := strconv.Atoi(s)
+	if err != nil {
+		v.AddError(key, "must be an integer value")
+		return defaultValue
+	}
+	return i
+}
+
+func (app *application) readBool(qs url.Values, key string, v *validator.Validator) *bool {
+	s := qs.Get(key)
+	if s == "" {
+		return nil
+	}
+
+	b, err := strconv.ParseBool(s)
+	if err != nil {
+		v.AddError(key, "must be a boolean value")
+		return nil
+	}
+	return &b
+}
+
+// paginationLinks builds a Link header value with first, prev, next and last
+// relations for the request's URL.
+func (app *application) paginationLinks(r *http.Request, metadata models.Metadata) string {
+	if metadata.TotalRecords == 0 {
+		return ""
+	}
+
+	link := func(page int, rel string) string {
+		u := *r.URL
+		qs := u.Query()
+		qs.Set("page", strconv.Itoa(page))
+		qs.Set("page_size", strconv.Itoa(metadata.PageSize))
+		u.RawQuery = qs.Encode()
+		return fmt.Sprintf("<%s>; rel=%q", u.RequestURI(), rel)
+	}
+
+	links := []string{link(metadata.FirstPage, "first")}
+	if metadata.CurrentPage > metadata.FirstPage {
+		links = append(links, link(metadata.CurrentPage-1, "prev"))
+	}
+	if metadata.CurrentPage < metadata.LastPage {
+		links = append(links, link(metadata.CurrentPage+1, "next"))
+	}
+	links = append(links, link(metadata.LastPage, "last"))
+
+	return strings.Join(links, ", ")
+}
+
+var errMissingIfMatch = errors.New("missing If-Match header")
+
+func etag(version int32) string {
+	return strconv.Quote(strconv.FormatInt(int64(version), 10))
+}
+
+// ifMatch reports whether the If-Match header of the request matches the
+// given version of a resource. Weak tags never match because If-Match
+// requires a strong comparison.
+func (app *application) ifMatch(r *http.Request, version int32) (bool, error) {
+	header := r.Header.Get("If-Match")
+	if header == "" {
+		return false, errMissingIfMatch
+	}
+
+	for _, tag := range strings.Split(header, ",") {
+		tag = strings.TrimSpace(tag)
+		if tag == "*" || tag == etag(version) {
+			return true, nil
+		}
+	}
+
+	return false, nil
+}
+
 func (app *application) background(fn func()) {
 	app.waitgroup.Add(1)
 
@@ -105,3 +204,28 @@ func (app *application) background(fn func()) {
 		fn()
 	}()
 }
+
+// newEmail renders a mail template into an email for the outbox.
+func (app *application) newEmail(recipient, locale string, data mail.Data) (*models.Email, error) {
+	msg, err := app.templates.Render(recipient, locale, data)
+	if err != nil {
+		return nil, err
+	}
+
+	email := &models.Email{
+		Recipient: msg.To,
+		Subject:   msg.Subject,
+		PlainBody: msg.PlainBody,
+		HTMLBody:  msg.HTMLBody,
+	}
+
+	return email, nil
+}
+
+func clientIP(r *http.Request) string {
+	ip, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return ip
+}
@@ -1,18 +1,32 @@
 package main
 
 import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"errors"
 	"flag"
+	"fmt"
 	"os"
-	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
+	"github.com/redis/go-redis/v9"
 	"k8s.io/client-go/kubernetes"
 	"k8s.io/client-go/tools/clientcmd"
 
+	"github.com/Li-Elias/Railclone/internal/certs"
+	"github.com/Li-Elias/Railclone/internal/challenge"
 	"github.com/Li-Elias/Railclone/internal/db"
+	"github.com/Li-Elias/Railclone/internal/deployments"
 	"github.com/Li-Elias/Railclone/internal/jsonlog"
 	"github.com/Li-Elias/Railclone/internal/mail"
 	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/Li-Elias/Railclone/internal/oidc"
+	"github.com/Li-Elias/Railclone/internal/ratelimit"
+	"github.com/Li-Elias/Railclone/internal/validator"
+	"github.com/Li-Elias/Railclone/internal/webhooks"
 )
 
 type config struct {
@@ -21,18 +35,75 @@ type config struct {
 	cors struct {
 		allowedOrigins []string
 	}
-	kubeconfig string
+	migrate               string
+	kubeconfig            string
+	kubeTimeout           time.Duration
+	deletionSweepInterval time.Duration
 	db.DB
-	mail.SMTP
+	mail   mail.Config
+	oidc   oidc.Config
+	outbox struct {
+		pollInterval time.Duration
+		maxAttempts  int
+		status       bool
+	}
+	promoteAdmin string
+	redis        struct {
+		dsn string
+	}
+	rateLimit struct {
+		policiesFile string
+		policies     map[string]ratelimit.Policy
+	}
+	tokenQuota models.Quota
+	challenge  struct {
+		kind          string
+		powDifficulty int
+		powSecret     string
+		captchaURL    string
+		captchaSecret string
+	}
+	tls struct {
+		certFile       string
+		keyFile        string
+		redirectPort   int
+		reloadInterval time.Duration
+	}
+	webhooks struct {
+		pollInterval time.Duration
+		maxAttempts  int
+		concurrency  int
+		timeout      time.Duration
+		allowPrivate bool
+	}
+	readyzSMTP    bool
+	shutdownDelay time.Duration
+	file          string
+	printConfig   bool
+	version       bool
 }
 
 type application struct {
-	config    config
-	logger    *jsonlog.Logger
-	waitgroup sync.WaitGroup
-	models    models.Models
-	mailer    mail.Mailer
-	clientset *kubernetes.Clientset
+	config      config
+	logger      *jsonlog.Logger
+	waitgroup   sync.WaitGroup
+	db          *sql.DB
+	models      models.Models
+	mailer      mail.Mailer
+	templates   *mail.Templates
+	oidc        *oidc.Provider
+	redis       *redis.Client
+	limiter     ratelimit.Limiter
+	challenge   challenge.Verifier
+	pow         *challenge.ProofOfWork
+	certs       *certs.Reloader
+	clientset   *kubernetes.Clientset
+	deployments *deployments.Manager
+	webhooks    *webhooks.Sender
+	events      *eventHub
+	readiness   readinessCache
+
+	shuttingDown atomic.Bool
 }
 
 func main() {
@@ -40,9 +111,21 @@ func main() {
 
 	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
 
+	flag.StringVar(&cfg.file, "config", "", "YAML config file (or RAILCLONE_CONFIG)")
+	flag.BoolVar(&cfg.printConfig, "print-config", false, "Print the effective configuration with secrets redacted and exit")
+	flag.BoolVar(&cfg.version, "version", false, "Print the version and exit")
+
 	flag.IntVar(&cfg.port, "port", 4000, "API server port")
 	flag.StringVar(&cfg.env, "env", "development", "Environment (development|staging|production)")
 
+	flag.BoolVar(&cfg.readyzSMTP, "readyz-smtp", false, "Check the SMTP server in /readyz")
+	flag.DurationVar(&cfg.shutdownDelay, "shutdown-delay", 0, "Time between failing /readyz and shutting down, to let load balancers drain")
+
+	flag.StringVar(&cfg.tls.certFile, "tls-cert", "", "TLS certificate file (serves HTTPS and HTTP/2 if set)")
+	flag.StringVar(&cfg.tls.keyFile, "tls-key", "", "TLS private key file")
+	flag.IntVar(&cfg.tls.redirectPort, "tls-redirect-port", 0, "Port of a plain HTTP listener redirecting to HTTPS (disabled if 0)")
+	flag.DurationVar(&cfg.tls.reloadInterval, "tls-reload-interval", time.Minute, "Interval between checks for a changed TLS certificate")
+
 	flag.StringVar(&cfg.DB.Dsn, "db-dsn", "", "PostgreSQL DSN")
 	flag.IntVar(&cfg.DB.MaxOpenConns, "db-max-open-conns", 25, "PostgreSQL max open connections")
 	flag.IntVar(&cfg.DB.MaxIdleConns, "db-max-idle-conns", 25, "PostgreSQL max idle connections")
@@ -52,37 +135,128 @@ func main() {
 		"15m",
 		"PostgreSQL max connection idle time",
 	)
+	flag.DurationVar(&cfg.DB.QueryTimeout, "db-query-timeout", 3*time.Second, "PostgreSQL query timeout")
+	flag.BoolVar(&cfg.DB.AutoMigrate, "db-auto-migrate", true, "Apply pending database migrations on startup")
+	flag.StringVar(&cfg.migrate, "migrate", "", "Run database migrations and exit (up|down|status)")
 
-	flag.StringVar(&cfg.SMTP.Host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
-	flag.IntVar(&cfg.SMTP.Port, "smtp-port", 25, "SMTP port")
-	flag.StringVar(&cfg.SMTP.Username, "smtp-username", "", "SMTP username")
-	flag.StringVar(&cfg.SMTP.Password, "smtp-password", "", "SMTP password")
-	flag.StringVar(&cfg.SMTP.Sender, "smtp-sender", "<no-reply@file-transfer.io>", "SMTP sender")
+	flag.StringVar(&cfg.mail.Transport, "mail-transport", mail.TransportSMTP, "Mail transport (smtp|console|maildir|memory)")
+	flag.StringVar(&cfg.mail.Sender, "mail-sender", "<no-reply@file-transfer.io>", "Mail sender")
+	flag.StringVar(&cfg.mail.Maildir, "mail-maildir", "./maildir", "Maildir directory for the maildir transport")
 
-	flag.StringVar(&cfg.kubeconfig, "kubeconfig", "", "absolute path to kubeconfig file")
+	flag.DurationVar(&cfg.outbox.pollInterval, "mail-outbox-interval", 5*time.Second, "Interval between email outbox deliveries")
+	flag.IntVar(&cfg.outbox.maxAttempts, "mail-max-attempts", 8, "Delivery attempts before an email is dead-lettered")
+	flag.BoolVar(&cfg.outbox.status, "mail-outbox-status", false, "Print the email outbox delivery status and exit")
+
+	flag.StringVar(&cfg.mail.SMTP.Host, "smtp-host", "sandbox.smtp.mailtrap.io", "SMTP host")
+	flag.IntVar(&cfg.mail.SMTP.Port, "smtp-port", 25, "SMTP port")
+	flag.StringVar(&cfg.mail.SMTP.Username, "smtp-username", "", "SMTP username")
+	flag.StringVar(&cfg.mail.SMTP.Password, "smtp-password", "", "SMTP password")
+
+	flag.StringVar(&cfg.oidc.Issuer, "oidc-issuer", "", "OpenID Connect issuer URL (disables OIDC login if empty)")
+	flag.StringVar(&cfg.oidc.ClientID, "oidc-client-id", "", "OpenID Connect client ID")
+	flag.StringVar(&cfg.oidc.ClientSecret, "oidc-client-secret", "", "OpenID Connect client secret")
+	flag.StringVar(&cfg.oidc.RedirectURL, "oidc-redirect-url", "", "OpenID Connect redirect URL (the /v1/tokens/oidc/callback endpoint)")
+
+	flag.StringVar(&cfg.promoteAdmin, "promote-admin", "", "Give the user with this email address the admin role and exit")
+
+	flag.StringVar(&cfg.redis.dsn, "redis-dsn", "", "Redis URL for shared rate limits (in-memory rate limits if empty)")
+	flag.StringVar(&cfg.rateLimit.policiesFile, "ratelimit-policies", "", "JSON file with rate limit policies overriding the defaults")
+
+	flag.IntVar(&cfg.tokenQuota.EmailLimit, "token-email-quota", 5, "Emailed token requests allowed per email address and quota window")
+	flag.IntVar(&cfg.tokenQuota.IPLimit, "token-ip-quota", 20, "Emailed token requests allowed per IP and quota window")
+	flag.DurationVar(&cfg.tokenQuota.Window, "token-quota-window", time.Hour, "Window of the emailed token request quotas")
+
+	flag.StringVar(&cfg.challenge.kind, "token-challenge", challenge.KindNone, "Challenge required before sending emails (none|pow|captcha)")
+	flag.IntVar(&cfg.challenge.powDifficulty, "pow-difficulty", 20, "Leading zero bits required by proof-of-work challenges")
+	flag.StringVar(&cfg.challenge.powSecret, "pow-secret", "", "Secret signing proof-of-work challenges (random if empty)")
+	flag.StringVar(&cfg.challenge.captchaURL, "captcha-verify-url", "", "CAPTCHA siteverify URL")
+	flag.StringVar(&cfg.challenge.captchaSecret, "captcha-secret", "", "CAPTCHA secret key")
+
+	flag.DurationVar(&cfg.webhooks.pollInterval, "webhook-interval", 5*time.Second, "Interval between webhook deliveries")
+	flag.IntVar(&cfg.webhooks.maxAttempts, "webhook-max-attempts", 8, "Delivery attempts before a webhook delivery is given up on")
+	flag.IntVar(&cfg.webhooks.concurrency, "webhook-concurrency", 10, "Webhook deliveries sent at the same time")
+	flag.DurationVar(&cfg.webhooks.timeout, "webhook-timeout", 10*time.Second, "Timeout of a webhook delivery")
+	flag.BoolVar(&cfg.webhooks.allowPrivate, "webhook-allow-private", false, "Allow webhooks to loopback, private, shared and link-local addresses")
 
-	flag.Func(
-		"cors-allowed-origins",
-		"Allowed CORS origins (space separated)",
-		func(val string) error {
-			cfg.cors.allowedOrigins = strings.Fields(val)
-			return nil
-		},
+	flag.StringVar(&cfg.kubeconfig, "kubeconfig", "", "absolute path to kubeconfig file")
+	flag.DurationVar(&cfg.kubeTimeout, "kube-timeout", 10*time.Second, "Kubernetes API request timeout")
+	flag.DurationVar(
+		&cfg.deletionSweepInterval,
+		"deletion-sweep-interval",
+		time.Minute,
+		"Interval between retries of unfinished deployment deletions",
 	)
 
+	flag.Var((*fieldsValue)(&cfg.cors.allowedOrigins), "cors-allowed-origins", "Allowed CORS origins (space separated)")
+
 	flag.Parse()
 
-	db, err := db.Init(&cfg.DB)
+	if cfg.version {
+		fmt.Printf("version:\t%s\ncommit:\t\t%s\n", version, commit)
+		return
+	}
+
+	err := loadConfig(flag.CommandLine, cfg.file)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	if cfg.printConfig {
+		err = printConfig(os.Stdout, flag.CommandLine)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
+	v := validator.New()
+	if validateConfig(v, &cfg); !v.Valid() {
+		logger.PrintFatal(errors.New("invalid configuration"), v.Errors)
+	}
+
+	pool, err := db.Init(&cfg.DB)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
-	defer db.Close()
+	defer pool.Close()
 	logger.PrintInfo("database connection pool established", nil)
 
+	if cfg.migrate != "" {
+		err = migrate(logger, pool, cfg.migrate)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
+	err = checkSchema(logger, pool, cfg.DB.AutoMigrate)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	models := models.NewModels(pool, cfg.DB.QueryTimeout)
+
+	if cfg.promoteAdmin != "" {
+		err = promoteAdmin(logger, models, cfg.promoteAdmin)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
+	if cfg.outbox.status {
+		err = outboxStatus(logger, models)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		return
+	}
+
 	config, err := clientcmd.BuildConfigFromFlags("", cfg.kubeconfig)
 	if err != nil {
 		logger.PrintFatal(err, nil)
 	}
+	config.Timeout = cfg.kubeTimeout
 
 	clientset, err := kubernetes.NewForConfig(config)
 	if err != nil {
@@ -90,12 +264,78 @@ func main() {
 	}
 	logger.PrintInfo("kubernetes clientset established", nil)
 
+	mailer, err := mail.New(&cfg.mail)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	templates, err := mail.ParseTemplates()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	cfg.rateLimit.policies, err = ratelimit.LoadPolicies(cfg.rateLimit.policiesFile)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	var redisClient *redis.Client
+	var limiter ratelimit.Limiter = ratelimit.NewMemoryLimiter()
+	if cfg.redis.dsn != "" {
+		opts, err := redis.ParseURL(cfg.redis.dsn)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		redisClient = redis.NewClient(opts)
+		defer redisClient.Close()
+
+		limiter = ratelimit.NewRedisLimiter(redisClient, limiter)
+		logger.PrintInfo("redis client configured", nil)
+	}
+
+	verifier, pow, err := newChallenge(&cfg, models)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	var reloader *certs.Reloader
+	if cfg.tls.certFile != "" {
+		reloader, err = certs.New(cfg.tls.certFile, cfg.tls.keyFile)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+	}
+
+	var provider *oidc.Provider
+	if cfg.oidc.Enabled() {
+		ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+		provider, err = oidc.New(ctx, &cfg.oidc)
+		cancel()
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+		logger.PrintInfo("oidc provider discovered", map[string]string{
+			"issuer": cfg.oidc.Issuer,
+		})
+	}
+
 	app := &application{
-		config:    cfg,
-		logger:    logger,
-		models:    models.NewModels(db),
-		mailer:    mail.New(&cfg.SMTP),
-		clientset: clientset,
+		config:      cfg,
+		logger:      logger,
+		db:          pool,
+		models:      models,
+		mailer:      mailer,
+		templates:   templates,
+		oidc:        provider,
+		redis:       redisClient,
+		limiter:     limiter,
+		challenge:   verifier,
+		pow:         pow,
+		certs:       reloader,
+		clientset:   clientset,
+		deployments: deployments.New(clientset, models, webhookNotifier{logger: logger, models: models}),
+		webhooks:    webhooks.NewSender(cfg.webhooks.timeout, cfg.webhooks.allowPrivate),
+		events:      newEventHub(),
 	}
 
 	err = app.serve()
@@ -103,3 +343,36 @@ func main() {
 		logger.PrintFatal(err, nil)
 	}
 }
+
+// newChallenge returns the verifier of the challenge configured with
+// -token-challenge, and the proof-of-work issuer if that is the one.
+func newChallenge(cfg *config, m models.Models) (challenge.Verifier, *challenge.ProofOfWork, error) {
+	switch cfg.challenge.kind {
+	case challenge.KindNone:
+		return challenge.None{}, nil, nil
+
+	case challenge.KindProofOfWork:
+		secret := []byte(cfg.challenge.powSecret)
+		if len(secret) == 0 {
+			// challenges issued by one replica cannot be verified by another
+			secret = make([]byte, 32)
+			_, err := rand.Read(secret)
+			if err != nil {
+				return nil, nil, err
+			}
+		}
+
+		pow := challenge.NewProofOfWork(secret, m.UsedChallenges, cfg.challenge.powDifficulty, 5*time.Minute)
+		return pow, pow, nil
+
+	case challenge.KindCaptcha:
+		if cfg.challenge.captchaURL == "" || cfg.challenge.captchaSecret == "" {
+			return nil, nil, errors.New("captcha challenge requires -captcha-verify-url and -captcha-secret")
+		}
+
+		return challenge.NewCaptcha(cfg.challenge.captchaURL, cfg.challenge.captchaSecret), nil, nil
+
+	default:
+		return nil, nil, fmt.Errorf("unknown token challenge %q (none|pow|captcha)", cfg.challenge.kind)
+	}
+}
@@ -1,17 +1,42 @@
 package main
 
 import (
+	"crypto/sha256"
+	"encoding/hex"
 	"errors"
 	"fmt"
+	"math"
 	"net/http"
+	"strconv"
 	"strings"
 	"time"
 
+	"github.com/Li-Elias/Railclone/internal/challenge"
 	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/Li-Elias/Railclone/internal/ratelimit"
 	"github.com/Li-Elias/Railclone/internal/validator"
 	"github.com/go-chi/chi/v5/middleware"
 )
 
+// requestID gives every request an ID, taken from the X-Request-Id header if
+// the client sent one, and returns it in the response.
+func (app *application) requestID(next http.Handler) http.Handler {
+	return middleware.RequestID(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set(middleware.RequestIDHeader, middleware.GetReqID(r.Context()))
+		next.ServeHTTP(w, r)
+	}))
+}
+
+// varyLanguage tells caches that responses depend on Accept-Language, since
+// the messages of anonymous requests are translated into the locale it asks
+// for.
+func (app *application) varyLanguage(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Add("Vary", "Accept-Language")
+		next.ServeHTTP(w, r)
+	})
+}
+
 func (app *application) Logger(next http.Handler) http.Handler {
 	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
 		ww := middleware.NewWrapResponseWriter(w, r.ProtoMajor)
@@ -19,11 +44,12 @@ func (app *application) Logger(next http.Handler) http.Handler {
 
 		defer func() {
 			app.logger.PrintInfo("Request log", map[string]string{
-				"method": r.Method,
-				"url":    r.RequestURI,
-				"status": fmt.Sprintf("%d", ww.Status()),
-				"bytes":  fmt.Sprintf("%d", ww.BytesWritten()),
-				"µs":     fmt.Sprintf("%d", time.Since(start_time).Microseconds()),
+				"request_id": middleware.GetReqID(r.Context()),
+				"method":     r.Method,
+				"url":        r.RequestURI,
+				"status":     fmt.Sprintf("%d", ww.Status()),
+				"bytes":      fmt.Sprintf("%d", ww.BytesWritten()),
+				"µs":         fmt.Sprintf("%d", time.Since(start_time).Microseconds()),
 			})
 		}()
 		next.ServeHTTP(ww, r)
@@ -55,7 +81,7 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
-		user, err := app.models.Users.GetForToken(models.ScopeAuthentication, token)
+		user, err := app.models.Users.GetForToken(r.Context(), models.ScopeAuthentication, token)
 		if err != nil {
 			switch {
 			case errors.Is(err, models.ErrRecordNotFound):
@@ -66,6 +92,11 @@ func (app *application) authenticate(next http.Handler) http.Handler {
 			return
 		}
 
+		if user.Suspended {
+			app.accountSuspendedResponse(w, r)
+			return
+		}
+
 		r = app.contextSetUser(r, user)
 
 		next.ServeHTTP(w, r)
@@ -97,3 +128,111 @@ func (app *application) requireActivatedUser(next http.Handler) http.Handler {
 
 	return app.requireAuthenticatedUser(fn)
 }
+
+func (app *application) requireAdmin(next http.Handler) http.Handler {
+	fn := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !user.IsAdmin() {
+			app.notPermittedResponse(w, r)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+
+	return app.requireActivatedUser(fn)
+}
+
+func (app *application) requireSecondFactor(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		user := app.contextGetUser(r)
+
+		if !app.checkSecondFactor(w, r, user) {
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func (app *application) rateLimit(name string) func(http.Handler) http.Handler {
+	policy, ok := app.config.rateLimit.policies[name]
+	if !ok {
+		panic(fmt.Sprintf("missing rate limit policy %q", name))
+	}
+
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			key := name + ":" + app.rateLimitKey(r, policy.Key)
+
+			result, err := app.limiter.Allow(r.Context(), key, policy.Limit, time.Duration(policy.Window))
+			if err != nil {
+				app.logError(r, err)
+			}
+			if result.Limit == 0 {
+				next.ServeHTTP(w, r)
+				return
+			}
+
+			reset := int(math.Ceil(result.Reset.Seconds()))
+
+			w.Header().Set("RateLimit-Limit", strconv.Itoa(result.Limit))
+			w.Header().Set("RateLimit-Remaining", strconv.Itoa(result.Remaining))
+			w.Header().Set("RateLimit-Reset", strconv.Itoa(reset))
+			w.Header().Set("RateLimit-Policy", fmt.Sprintf("%d;w=%d", policy.Limit, int(time.Duration(policy.Window).Seconds())))
+
+			if !result.Allowed {
+				w.Header().Set("Retry-After", strconv.Itoa(reset))
+				app.tooManyRequests(w, r)
+				return
+			}
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
+
+// rateLimitKey identifies who a request is counted against. Anonymous
+// requests are counted per IP whatever the policy says.
+func (app *application) rateLimitKey(r *http.Request, key string) string {
+	user := app.contextGetUser(r)
+
+	switch {
+	case key == ratelimit.KeyUser && !user.IsAnonymous():
+		return "user:" + strconv.FormatInt(user.ID, 10)
+	case key == ratelimit.KeyToken && !user.IsAnonymous():
+		hash := sha256.Sum256([]byte(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")))
+		return "token:" + hex.EncodeToString(hash[:])
+	}
+
+	return "ip:" + clientIP(r)
+}
+
+func (app *application) requireChallenge(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		err := app.challenge.Verify(r.Context(), r, clientIP(r))
+		if err != nil {
+			switch {
+			case errors.Is(err, challenge.ErrFailed):
+				app.challengeFailedResponse(w, r)
+			default:
+				app.serverErrorResponse(w, r, err)
+			}
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// deprecated marks the responses of retired routes with the Deprecation and
+// Sunset headers, and links to the same path under successor.
+func (app *application) deprecated(sunset time.Time, successor string) func(http.Handler) http.Handler {
+	return func(next http.Handler) http.Handler {
+		return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Deprecation", "true")
+			w.Header().Set("Sunset", sunset.Format(http.TimeFormat))
+			w.Header().Add("Link", fmt.Sprintf("<%s%s>; rel=\"successor-version\"", successor, r.URL.Path))
+
+			next.ServeHTTP(w, r)
+		})
+	}
+}
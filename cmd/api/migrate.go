@@ -0,0 +1,85 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"strconv"
+	"strings"
+
+	"github.com/Li-Elias/Railclone/internal/db"
+	"github.com/Li-Elias/Railclone/internal/jsonlog"
+	"github.com/Li-Elias/Railclone/migrations"
+)
+
+// migrate runs the migration command given with the -migrate flag.
+func migrate(logger *jsonlog.Logger, pool *sql.DB, command string) error {
+	migrator, err := db.NewMigrator(pool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	switch command {
+	case "up":
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		logger.PrintInfo("applied up migrations", map[string]string{
+			"migrations": strings.Join(applied, " "),
+		})
+
+	case "down":
+		rolledBack, err := migrator.Down(ctx)
+		if err != nil {
+			return err
+		}
+		logger.PrintInfo("rolled back migration", map[string]string{
+			"migration": rolledBack,
+		})
+
+	case "status":
+		status, err := migrator.Status(ctx)
+		if err != nil {
+			return err
+		}
+		logger.PrintInfo("migration status", map[string]string{
+			"version": strconv.FormatInt(status.Version, 10),
+			"latest":  strconv.FormatInt(status.Latest, 10),
+			"dirty":   strconv.FormatBool(status.Dirty),
+			"pending": strings.Join(status.Pending, " "),
+		})
+
+	default:
+		return fmt.Errorf("unknown migrate command %q (up|down|status)", command)
+	}
+
+	return nil
+}
+
+// checkSchema optionally applies pending migrations and then makes sure the
+// database schema is at the version this build expects.
+func checkSchema(logger *jsonlog.Logger, pool *sql.DB, autoMigrate bool) error {
+	migrator, err := db.NewMigrator(pool, migrations.FS)
+	if err != nil {
+		return err
+	}
+
+	ctx := context.Background()
+
+	if autoMigrate {
+		applied, err := migrator.Up(ctx)
+		if err != nil {
+			return err
+		}
+		if len(applied) != 0 {
+			logger.PrintInfo("applied up migrations", map[string]string{
+				"migrations": strings.Join(applied, " "),
+			})
+		}
+	}
+
+	return migrator.Check(ctx)
+}
@@ -0,0 +1,186 @@
+package main
+
+import (
+	"crypto/sha256"
+	"crypto/subtle"
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/Li-Elias/Railclone/internal/oidc"
+	"github.com/Li-Elias/Railclone/internal/validator"
+)
+
+const (
+	oidcLoginTTL    = 10 * time.Minute
+	oidcStateCookie = "oidc_state"
+)
+
+func (app *application) oidcLoginHandler(w http.ResponseWriter, r *http.Request) {
+	login, err := oidc.NewLogin()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.OIDCLogins.Insert(r.Context(), &models.OIDCLogin{
+		State:        login.State,
+		Nonce:        login.Nonce,
+		CodeVerifier: login.CodeVerifier,
+		Expiry:       time.Now().Add(oidcLoginTTL),
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	app.setOIDCStateCookie(w, login.State, oidcLoginTTL)
+
+	http.Redirect(w, r, app.oidc.AuthCodeURL(login), http.StatusFound)
+}
+
+func (app *application) oidcCallbackHandler(w http.ResponseWriter, r *http.Request) {
+	// the cookie is of no use after this request, whatever its outcome
+	stateCookie, _ := r.Cookie(oidcStateCookie)
+	app.setOIDCStateCookie(w, "", -1)
+
+	qs := r.URL.Query()
+
+	if errorCode := qs.Get("error"); errorCode != "" {
+		app.logger.PrintInfo("oidc login rejected by identity provider", map[string]string{
+			"error":             errorCode,
+			"error_description": qs.Get("error_description"),
+		})
+		app.invalidCredentialsResponse(w, r)
+		return
+	}
+
+	state := app.readString(qs, "state", "")
+	code := app.readString(qs, "code", "")
+
+	v := validator.New()
+	v.Check(state != "", "state", "must be provided")
+	v.Check(code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	if stateCookie == nil || subtle.ConstantTimeCompare([]byte(stateCookie.Value), []byte(hashOIDCState(state))) != 1 {
+		v.AddError("state", "invalid or expired login state")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	stored, err := app.models.OIDCLogins.Consume(r.Context(), state)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("state", "invalid or expired login state")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	login := &oidc.Login{
+		State:        stored.State,
+		Nonce:        stored.Nonce,
+		CodeVerifier: stored.CodeVerifier,
+	}
+
+	identity, err := app.oidc.Exchange(r.Context(), login, code)
+	if err != nil {
+		switch {
+		case errors.Is(err, oidc.ErrUnverifiedEmail), errors.Is(err, oidc.ErrMissingEmailClaim):
+			app.unverifiedEmailResponse(w, r)
+		default:
+			app.logError(r, err)
+			app.invalidCredentialsResponse(w, r)
+		}
+		return
+	}
+
+	locale := i18n.Match(r.Header.Get("Accept-Language"))
+
+	user, err := app.models.Users.GetOrCreateForIdentity(r.Context(), identity.Issuer, identity.Subject, identity.Email, locale)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeActivation, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	t, err := app.twoFactorEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if t != nil {
+		token, err := app.models.Tokens.New(r.Context(), user.ID, twoFactorTTL, models.ScopeTwoFactor)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		err = app.writeJSON(w, http.StatusOK, envelope{"two_factor_token": token}, nil)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 2*time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"token": token, "user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+// setOIDCStateCookie binds a login to the browser that started it, so that a
+// callback with the state of a login started elsewhere is rejected. The
+// cookie holds a hash of the state and is only sent to the redirect URL. A
+// negative maxAge removes it.
+func (app *application) setOIDCStateCookie(w http.ResponseWriter, state string, maxAge time.Duration) {
+	path := "/"
+	redirectURL, err := url.Parse(app.config.oidc.RedirectURL)
+	if err == nil && redirectURL.Path != "" {
+		path = redirectURL.Path
+	}
+
+	cookie := &http.Cookie{
+		Name:     oidcStateCookie,
+		Path:     path,
+		MaxAge:   -1,
+		Secure:   strings.HasPrefix(app.config.oidc.RedirectURL, "https://"),
+		HttpOnly: true,
+		SameSite: http.SameSiteLaxMode,
+	}
+	if maxAge > 0 {
+		cookie.Value = hashOIDCState(state)
+		cookie.MaxAge = int(maxAge.Seconds())
+	}
+
+	http.SetCookie(w, cookie)
+}
+
+func hashOIDCState(state string) string {
+	hash := sha256.Sum256([]byte(state))
+	return base64.RawURLEncoding.EncodeToString(hash[:])
+}
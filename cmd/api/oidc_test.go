@@ -0,0 +1,66 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestOIDCStateCookie(t *testing.T) {
+	app := &application{}
+	app.config.oidc.RedirectURL = "https://railclone.test/v1/tokens/oidc/callback"
+
+	rr := httptest.NewRecorder()
+	app.setOIDCStateCookie(rr, "state", oidcLoginTTL)
+
+	cookies := rr.Result().Cookies()
+	if len(cookies) != 1 {
+		t.Fatalf("got %d cookies; want 1", len(cookies))
+	}
+	cookie := cookies[0]
+
+	switch {
+	case cookie.Value != hashOIDCState("state"):
+		t.Errorf("got value %q; want the hash of the state", cookie.Value)
+	case cookie.Path != "/v1/tokens/oidc/callback":
+		t.Errorf("got path %q; want the path of the redirect URL", cookie.Path)
+	case !cookie.HttpOnly || !cookie.Secure || cookie.SameSite != http.SameSiteLaxMode:
+		t.Errorf("got HttpOnly %t, Secure %t, SameSite %v; want an HttpOnly, Secure, SameSite=Lax cookie", cookie.HttpOnly, cookie.Secure, cookie.SameSite)
+	case cookie.MaxAge != int(oidcLoginTTL.Seconds()):
+		t.Errorf("got max age %d; want %d", cookie.MaxAge, int(oidcLoginTTL.Seconds()))
+	}
+}
+
+func TestOIDCCallbackRejectsStateOfAnotherBrowser(t *testing.T) {
+	app := &application{}
+	app.config.oidc.RedirectURL = "https://railclone.test/v1/tokens/oidc/callback"
+
+	tests := []struct {
+		name   string
+		cookie *http.Cookie
+	}{
+		{"no cookie", nil},
+		{"cookie of another login", &http.Cookie{Name: oidcStateCookie, Value: hashOIDCState("other")}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			r := httptest.NewRequest(http.MethodGet, "/v1/tokens/oidc/callback?state=state&code=code", nil)
+			if tt.cookie != nil {
+				r.AddCookie(tt.cookie)
+			}
+
+			rr := httptest.NewRecorder()
+			app.oidcCallbackHandler(rr, r)
+
+			if rr.Code != http.StatusUnprocessableEntity {
+				t.Errorf("got status %d; want %d", rr.Code, http.StatusUnprocessableEntity)
+			}
+
+			cookies := rr.Result().Cookies()
+			if len(cookies) != 1 || cookies[0].Name != oidcStateCookie || cookies[0].MaxAge >= 0 {
+				t.Errorf("got cookies %v; want the state cookie removed", cookies)
+			}
+		})
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strings"
+	"testing"
+
+	"github.com/go-chi/chi/v5"
+
+	"github.com/Li-Elias/Railclone/internal/challenge"
+	"github.com/Li-Elias/Railclone/internal/oidc"
+	"github.com/Li-Elias/Railclone/internal/openapi"
+	"github.com/Li-Elias/Railclone/internal/ratelimit"
+)
+
+// TestOpenAPIRoutesInSync compares the routes of the router with the
+// operations in the OpenAPI document. Optional routes are registered as if
+// everything was configured.
+func TestOpenAPIRoutesInSync(t *testing.T) {
+	policies, err := ratelimit.LoadPolicies("")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	app := &application{
+		pow:  &challenge.ProofOfWork{},
+		oidc: &oidc.Provider{},
+	}
+	app.config.rateLimit.policies = policies
+
+	routed := map[string]bool{}
+	err = chi.Walk(app.routes().(chi.Routes), func(method, route string, handler http.Handler, middlewares ...func(http.Handler) http.Handler) error {
+		routed[method+" "+route] = true
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// the unversioned aliases of the /v1 routes are not documented
+	for route := range routed {
+		method, path, _ := strings.Cut(route, " ")
+		if routed[method+" /v1"+path] {
+			delete(routed, route)
+		}
+	}
+
+	operations, err := openapi.Operations()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var problems []string
+	for _, operation := range operations {
+		if !routed[operation] {
+			problems = append(problems, "not routed: "+operation)
+		}
+		delete(routed, operation)
+	}
+	for route := range routed {
+		problems = append(problems, "not documented: "+route)
+	}
+
+	if len(problems) > 0 {
+		sort.Strings(problems)
+		t.Errorf("openapi document out of sync with the routes:\n%s", strings.Join(problems, "\n"))
+	}
+}
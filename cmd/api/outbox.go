@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strconv"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/jsonlog"
+	"github.com/Li-Elias/Railclone/internal/mail"
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+const (
+	outboxBatchSize  = 10
+	outboxLease      = 2 * time.Minute
+	outboxBackoff    = 30 * time.Second
+	outboxMaxBackoff = time.Hour
+)
+
+func (app *application) runOutboxWorker(ctx context.Context) {
+	ticker := time.NewTicker(app.config.outbox.pollInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := app.deliverEmails(ctx)
+			if err != nil && !errors.Is(err, models.ErrCanceled) {
+				app.logger.PrintError(err, map[string]string{
+					"worker": "email outbox",
+				})
+			}
+		}
+	}
+}
+
+// deliverEmails sends every email that is due until the outbox has nothing
+// left to claim.
+func (app *application) deliverEmails(ctx context.Context) error {
+	for {
+		emails, err := app.models.Outbox.Claim(ctx, outboxBatchSize, outboxLease)
+		if err != nil {
+			return err
+		}
+
+		for _, email := range emails {
+			err := app.deliverEmail(ctx, email)
+			if err != nil {
+				return err
+			}
+		}
+
+		if len(emails) < outboxBatchSize {
+			return nil
+		}
+	}
+}
+
+func (app *application) deliverEmail(ctx context.Context, email *models.Email) error {
+	err := app.mailer.Send(&mail.Message{
+		To:        email.Recipient,
+		Subject:   email.Subject,
+		PlainBody: email.PlainBody,
+		HTMLBody:  email.HTMLBody,
+	})
+	if err == nil {
+		return app.models.Outbox.MarkSent(ctx, email.ID)
+	}
+
+	properties := map[string]string{
+		"worker":   "email outbox",
+		"email_id": strconv.FormatInt(email.ID, 10),
+		"attempts": strconv.Itoa(email.Attempts),
+	}
+
+	if email.Attempts >= app.config.outbox.maxAttempts {
+		app.logger.PrintError(err, properties)
+		return app.models.Outbox.MarkDead(ctx, email.ID, err.Error())
+	}
+
+	app.logger.PrintInfo("email delivery failed, retrying", properties)
+	return app.models.Outbox.MarkFailed(ctx, email.ID, err.Error(), time.Now().Add(backoff(email.Attempts)))
+}
+
+// backoff doubles the delay after every failed attempt, up to outboxMaxBackoff.
+func backoff(attempts int) time.Duration {
+	delay := outboxBackoff
+	for i := 1; i < attempts && delay < outboxMaxBackoff; i++ {
+		delay *= 2
+	}
+	return min(delay, outboxMaxBackoff)
+}
+
+// outboxStatus prints the number of emails in each delivery state and the
+// emails that have been given up on.
+func outboxStatus(logger *jsonlog.Logger, m models.Models) error {
+	ctx := context.Background()
+
+	counts, err := m.Outbox.CountByStatus(ctx)
+	if err != nil {
+		return err
+	}
+
+	properties := make(map[string]string, len(counts))
+	for status, count := range counts {
+		properties[status] = strconv.Itoa(count)
+	}
+	logger.PrintInfo("email outbox status", properties)
+
+	dead, _, err := m.Outbox.GetAll(ctx, models.EmailDead, "", models.Filters{Page: 1, PageSize: 100})
+	if err != nil {
+		return err
+	}
+
+	for _, email := range dead {
+		logger.PrintInfo("undeliverable email", map[string]string{
+			"id":         strconv.FormatInt(email.ID, 10),
+			"recipient":  email.Recipient,
+			"subject":    email.Subject,
+			"attempts":   strconv.Itoa(email.Attempts),
+			"last_error": email.LastError,
+			"created_at": email.CreatedAt.Format(time.RFC3339),
+		})
+	}
+
+	return nil
+}
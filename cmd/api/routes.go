@@ -7,62 +7,138 @@ import (
 	"github.com/go-chi/chi/v5"
 	"github.com/go-chi/chi/v5/middleware"
 	"github.com/go-chi/cors"
-	"github.com/go-chi/httprate"
 )
 
+// apiVersions are the versions of the API, each mounted under its own path.
+var apiVersions = []string{"v1"}
+
+// legacySunset is when the unversioned aliases of the /v1 routes are removed.
+var legacySunset = time.Date(2027, time.April, 1, 0, 0, 0, 0, time.UTC)
+
 func (app *application) routes() http.Handler {
 	router := chi.NewRouter()
 
+	router.Use(app.requestID)
 	router.Use(app.Logger)
 	router.Use(middleware.Recoverer)
 	router.Use(cors.Handler(cors.Options{
-		AllowedOrigins:   app.config.cors.allowedOrigins,
-		AllowedMethods:   []string{"GET", "POST", "PUT", "DELETE", "OPTIONS"},
-		AllowedHeaders:   []string{"Accept", "Authorization", "Content-Type", "X-CSRF-Token"},
-		ExposedHeaders:   []string{"Link"},
+		AllowedOrigins: app.config.cors.allowedOrigins,
+		AllowedMethods: []string{"GET", "POST", "PUT", "PATCH", "DELETE", "OPTIONS"},
+		AllowedHeaders: []string{
+			"Accept", "Authorization", "Content-Type", "If-Match", "X-CSRF-Token", "X-TOTP-Code",
+			"X-Challenge", "X-Challenge-Nonce", "X-Captcha-Response", "Last-Event-ID",
+		},
+		ExposedHeaders: []string{
+			"ETag", "Link", "Retry-After", "X-Request-Id", "Deprecation", "Sunset",
+			"RateLimit-Limit", "RateLimit-Remaining", "RateLimit-Reset", "RateLimit-Policy",
+		},
 		AllowCredentials: false,
 		MaxAge:           300,
 	}))
+	router.Use(app.varyLanguage)
 	router.Use(app.authenticate)
-	router.Use(httprate.Limit(
-		10,
-		1*time.Minute,
-		httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-			app.tooManyRequests(w, r)
-		}),
-	))
 
 	router.NotFound(app.notFoundResponse)
 	router.MethodNotAllowed(app.methodNotAllowedResponse)
 
-	router.Get("/healthcheck", app.healthcheckHandler)
+	// probes are not rate limited
+	router.Get("/livez", app.livezHandler)
+	router.Get("/readyz", app.readyzHandler)
+
+	for _, version := range apiVersions {
+		router.Mount("/"+version, app.apiRoutes(version))
+	}
+
+	// the unversioned paths served the API before /v1 and remain as aliases
+	// until they are retired
+	router.With(app.deprecated(legacySunset, "/v1")).Mount("/", app.apiRoutes("v1"))
+
+	return router
+}
+
+// apiRoutes are the routes of a version of the API. Every version registers
+// the same routes; a handler that changes in a later version checks the
+// version it is registered for.
+func (app *application) apiRoutes(version string) http.Handler {
+	router := chi.NewRouter()
+
+	router.NotFound(app.notFoundResponse)
+	router.MethodNotAllowed(app.methodNotAllowedResponse)
+
+	router.Get("/openapi.json", app.openAPIHandler)
+	router.Get("/docs", app.docsHandler)
 
 	router.Group(func(router chi.Router) {
-		router.Use(app.requireActivatedUser)
-		router.Use(httprate.Limit(
-			5,
-			1*time.Minute,
-			httprate.WithLimitHandler(func(w http.ResponseWriter, r *http.Request) {
-				app.tooManyRequests(w, r)
-			}),
-		))
-
-		router.Get("/users/deployments", app.getUserDeploymentsHandler)
-		router.Post("/users/deployments", app.createDeploymentHandler)
-		router.Get("/users/deployments/{id}", app.getUserDeploymentHandler)
-		router.Put("/users/deployments/{id}", app.updateUserDeploymentHandler)
-		router.Delete("/users/deployments/{id}", app.deleteUserDeploymentHandler)
-	})
+		router.Use(app.rateLimit("global"))
 
-	router.Get("/deployments", app.listAvailableDeploymentsHandler)
+		router.Get("/healthcheck", app.healthcheckHandler)
 
-	router.Post("/users", app.registerUserHandler)
-	router.Put("/users/activated", app.activateUserHandler)
-	router.Post("/users/delete", app.deleteUserHandler)
+		router.Group(func(router chi.Router) {
+			router.Use(app.requireActivatedUser)
+			router.Use(app.rateLimit("deployments"))
 
-	router.Post("/tokens/activation", app.createActivationTokenHandler)
-	router.Post("/tokens/authentication", app.createAuthenticationTokenHandler)
-	router.Post("/tokens/deletion", app.createDeletionTokenHandler)
+			router.Get("/users/deployments", app.getUserDeploymentsHandler)
+			router.Post("/users/deployments", app.createDeploymentHandler)
+			router.Get("/users/deployments/events", app.deploymentEventsHandler)
+			router.Get("/users/deployments/{id}", app.getUserDeploymentHandler)
+			router.Put("/users/deployments/{id}", app.updateUserDeploymentHandler)
+			router.Patch("/users/deployments/{id}", app.patchUserDeploymentHandler)
+			router.With(app.requireSecondFactor).Delete("/users/deployments/{id}", app.deleteUserDeploymentHandler)
+
+			router.Get("/users/webhooks", app.listWebhooksHandler)
+			router.Post("/users/webhooks", app.createWebhookHandler)
+			router.Get("/users/webhooks/{id}", app.getWebhookHandler)
+			router.Patch("/users/webhooks/{id}", app.patchWebhookHandler)
+			router.Delete("/users/webhooks/{id}", app.deleteWebhookHandler)
+			router.Get("/users/webhooks/{id}/deliveries", app.listWebhookDeliveriesHandler)
+			router.Post("/users/webhooks/{id}/deliveries/{delivery_id}/redeliver", app.redeliverWebhookHandler)
+
+			router.Post("/users/totp", app.enrolTOTPHandler)
+			router.Put("/users/totp/enabled", app.confirmTOTPHandler)
+			router.With(app.requireSecondFactor).Delete("/users/totp", app.disableTOTPHandler)
+
+			router.With(app.requireSecondFactor).Put("/users/email", app.updateUserEmailHandler)
+		})
+
+		router.Group(func(router chi.Router) {
+			router.Use(app.requireAdmin)
+
+			router.Get("/admin/users", app.listUsersHandler)
+			router.Get("/admin/users/{id}", app.getUserHandler)
+			router.Put("/admin/users/{id}/suspended", app.updateUserSuspensionHandler)
+
+			router.Get("/admin/deployments", app.listDeploymentsHandler)
+			router.Get("/admin/deployments/{id}", app.getDeploymentHandler)
+			router.With(app.requireSecondFactor).Delete("/admin/deployments/{id}", app.deleteDeploymentHandler)
+
+			router.Get("/admin/emails", app.listEmailsHandler)
+		})
+
+		router.Get("/deployments", app.listAvailableDeploymentsHandler)
+
+		router.With(app.requireChallenge).Post("/users", app.registerUserHandler)
+		router.Put("/users/activated", app.activateUserHandler)
+		router.Post("/users/delete", app.deleteUserHandler)
+		router.Put("/users/email/confirmed", app.confirmUserEmailHandler)
+
+		router.Group(func(router chi.Router) {
+			router.Use(app.rateLimit("tokens"))
+
+			router.With(app.requireChallenge).Post("/tokens/activation", app.createActivationTokenHandler)
+			router.With(app.requireChallenge).Post("/tokens/authentication", app.createAuthenticationTokenHandler)
+			router.With(app.requireChallenge).Post("/tokens/deletion", app.createDeletionTokenHandler)
+			router.Post("/tokens/two-factor", app.createTwoFactorAuthenticationTokenHandler)
+
+			if app.pow != nil {
+				router.Post("/tokens/challenge", app.createChallengeHandler)
+			}
+
+			if app.oidc != nil {
+				router.Get("/tokens/oidc", app.oidcLoginHandler)
+				router.Get("/tokens/oidc/callback", app.oidcCallbackHandler)
+			}
+		})
+	})
 
 	return router
 }
@@ -2,12 +2,14 @@ package main
 
 import (
 	"context"
+	"crypto/tls"
 	"errors"
 	"fmt"
 	"log"
 	"net/http"
 	"os"
 	"os/signal"
+	"strconv"
 	"syscall"
 	"time"
 )
@@ -22,8 +24,64 @@ func (app *application) serve() error {
 		WriteTimeout: 30 * time.Second,
 	}
 
+	if app.certs != nil {
+		srv.TLSConfig = &tls.Config{
+			MinVersion:     tls.VersionTLS12,
+			GetCertificate: app.certs.GetCertificate,
+			NextProtos:     []string{"h2", "http/1.1"},
+		}
+	}
+
+	// event streams never finish on their own
+	srv.RegisterOnShutdown(app.events.close)
+
+	var redirect *http.Server
+	if app.certs != nil && app.config.tls.redirectPort != 0 {
+		redirect = &http.Server{
+			Addr:         fmt.Sprintf(":%d", app.config.tls.redirectPort),
+			Handler:      app.redirectToHTTPS(),
+			ErrorLog:     log.New(app.logger, "", 0),
+			IdleTimeout:  time.Minute,
+			ReadTimeout:  10 * time.Second,
+			WriteTimeout: 10 * time.Second,
+		}
+
+		go func() {
+			err := redirect.ListenAndServe()
+			if !errors.Is(err, http.ErrServerClosed) {
+				app.logger.PrintError(err, map[string]string{
+					"addr": redirect.Addr,
+				})
+			}
+		}()
+	}
+
 	shutdownError := make(chan error)
 
+	workers, stopWorkers := context.WithCancel(context.Background())
+	defer stopWorkers()
+
+	app.background(func() {
+		app.runDeletionSweeper(workers)
+	})
+	app.background(func() {
+		app.runOutboxWorker(workers)
+	})
+	app.background(func() {
+		app.runDeliveryWorker(workers)
+	})
+	app.background(func() {
+		app.runClusterWatcher(workers)
+	})
+	app.background(func() {
+		app.runEventListener(workers)
+	})
+	if app.certs != nil {
+		app.background(func() {
+			app.runCertReloader(workers)
+		})
+	}
+
 	go func() {
 		quit := make(chan os.Signal, 1)
 		signal.Notify(quit, syscall.SIGINT, syscall.SIGTERM)
@@ -34,9 +92,21 @@ func (app *application) serve() error {
 			"signal": s.String(),
 		})
 
+		// fail readiness checks first, so that load balancers stop sending
+		// new requests before the listeners are closed
+		app.shuttingDown.Store(true)
+		time.Sleep(app.config.shutdownDelay)
+
 		ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 		defer cancel()
 
+		if redirect != nil {
+			err := redirect.Shutdown(ctx)
+			if err != nil {
+				shutdownError <- err
+			}
+		}
+
 		err := srv.Shutdown(ctx)
 		if err != nil {
 			shutdownError <- err
@@ -46,6 +116,8 @@ func (app *application) serve() error {
 			"addr": srv.Addr,
 		})
 
+		stopWorkers()
+
 		app.waitgroup.Wait()
 		shutdownError <- nil
 	}()
@@ -53,9 +125,15 @@ func (app *application) serve() error {
 	app.logger.PrintInfo("starting server", map[string]string{
 		"addr": srv.Addr,
 		"env":  app.config.env,
+		"tls":  strconv.FormatBool(app.certs != nil),
 	})
 
-	err := srv.ListenAndServe()
+	var err error
+	if app.certs != nil {
+		err = srv.ListenAndServeTLS("", "")
+	} else {
+		err = srv.ListenAndServe()
+	}
 	if !errors.Is(err, http.ErrServerClosed) {
 		return err
 	}
@@ -0,0 +1,26 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"time"
+)
+
+func (app *application) runDeletionSweeper(ctx context.Context) {
+	ticker := time.NewTicker(app.config.deletionSweepInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			err := app.deployments.Sweep(ctx)
+			if err != nil && !errors.Is(err, context.Canceled) {
+				app.logger.PrintError(err, map[string]string{
+					"worker": "deletion sweeper",
+				})
+			}
+		}
+	}
+}
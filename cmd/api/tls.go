@@ -0,0 +1,82 @@
+package main
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"os"
+	"os/signal"
+	"strconv"
+	"syscall"
+	"time"
+)
+
+// runCertReloader reloads the TLS certificate on SIGHUP and whenever the
+// certificate or key file changes.
+func (app *application) runCertReloader(ctx context.Context) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	ticker := time.NewTicker(app.config.tls.reloadInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			app.reloadCert("SIGHUP")
+		case <-ticker.C:
+			changed, err := app.certs.Changed()
+			if err != nil {
+				app.logger.PrintError(err, map[string]string{
+					"worker": "certificate reloader",
+				})
+				continue
+			}
+			if changed {
+				app.reloadCert("file change")
+			}
+		}
+	}
+}
+
+func (app *application) reloadCert(trigger string) {
+	err := app.certs.Reload()
+	if err != nil {
+		app.logger.PrintError(err, map[string]string{
+			"worker":  "certificate reloader",
+			"trigger": trigger,
+		})
+		return
+	}
+
+	app.logger.PrintInfo("tls certificate reloaded", map[string]string{
+		"trigger": trigger,
+	})
+}
+
+// redirectToHTTPS is the handler of the plain HTTP listener when TLS is
+// enabled. It sends every request to the same URL on the HTTPS port.
+func (app *application) redirectToHTTPS() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// only GET and HEAD are redirected, other methods would be replayed
+		// by clients with their credentials in clear text
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			w.Header().Set("Connection", "close")
+			http.Error(w, "use HTTPS", http.StatusBadRequest)
+			return
+		}
+
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = r.Host
+		}
+		if app.config.port != 443 {
+			host = net.JoinHostPort(host, strconv.Itoa(app.config.port))
+		}
+
+		http.Redirect(w, r, "https://"+host+r.URL.RequestURI(), http.StatusMovedPermanently)
+	})
+}
@@ -3,8 +3,11 @@ package main
 import (
 	"errors"
 	"net/http"
+	"strconv"
 	"time"
 
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/mail"
 	"github.com/Li-Elias/Railclone/internal/models"
 	"github.com/Li-Elias/Railclone/internal/validator"
 )
@@ -26,41 +29,29 @@ func (app *application) createActivationTokenHandler(w http.ResponseWriter, r *h
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
-		return
-	}
-
-	if user.Activated {
-		v.AddError("email", "user has already been activated")
-		app.failedValidationResponse(w, r, v.Errors)
+	if !app.allowTokenRequest(w, r, input.Email) {
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, models.ScopeActivation)
-	if err != nil {
+	// unknown and already activated addresses get the same response, so that
+	// it does not reveal which addresses are registered
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case errors.Is(err, models.ErrRecordNotFound):
+	case err != nil:
 		app.serverErrorResponse(w, r, err)
 		return
-	}
-
-	app.background(func() {
-		models := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "user_activation.tmpl", models)
+	case !user.Activated:
+		_, err = app.models.Tokens.NewWithEmail(r.Context(), user.ID, 24*time.Hour, models.ScopeActivation, func(token *models.Token) (*models.Email, error) {
+			return app.newEmail(user.Email, user.Locale, mail.ActivationData{Token: token.Plaintext})
+		})
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-	})
+	}
 
-	env := envelope{"message": "an email will be sent to you containing activation instructions"}
+	env := envelope{"message": i18n.T(app.locale(r), "an email will be sent to you containing activation instructions")}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -84,35 +75,40 @@ func (app *application) createAuthenticationTokenHandler(w http.ResponseWriter,
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
-		default:
-			app.serverErrorResponse(w, r, err)
-		}
+	if !app.allowTokenRequest(w, r, input.Email) {
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 2*time.Hour, models.ScopeAuthentication)
-	if err != nil {
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case errors.Is(err, models.ErrRecordNotFound):
+	case err != nil:
 		app.serverErrorResponse(w, r, err)
 		return
-	}
+	default:
+		// with two-factor authentication enabled the emailed token only proves
+		// the first factor and has to be exchanged at /tokens/two-factor
+		ttl, scope := 2*time.Hour, models.ScopeAuthentication
 
-	app.background(func() {
-		models := map[string]interface{}{
-			"authenticationToken": token.Plaintext,
+		t, err := app.twoFactorEnabled(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+		if t != nil {
+			ttl, scope = twoFactorTTL, models.ScopeTwoFactor
 		}
 
-		err = app.mailer.Send(user.Email, "user_authentication.tmpl", models)
+		_, err = app.models.Tokens.NewWithEmail(r.Context(), user.ID, ttl, scope, func(token *models.Token) (*models.Email, error) {
+			return app.newEmail(user.Email, user.Locale, mail.AuthenticationData{Token: token.Plaintext})
+		})
 		if err != nil {
-			app.logger.PrintError(err, nil)
+			app.serverErrorResponse(w, r, err)
+			return
 		}
-	})
+	}
 
-	env := envelope{"message": "an email will be sent to you containing authentication instructions"}
+	env := envelope{"message": i18n.T(app.locale(r), "an email will be sent to you containing authentication instructions")}
 	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
@@ -136,36 +132,60 @@ func (app *application) createDeletionTokenHandler(w http.ResponseWriter, r *htt
 		return
 	}
 
-	user, err := app.models.Users.GetByEmail(input.Email)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrRecordNotFound):
-			app.invalidCredentialsResponse(w, r)
-		default:
+	if !app.allowTokenRequest(w, r, input.Email) {
+		return
+	}
+
+	user, err := app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case errors.Is(err, models.ErrRecordNotFound):
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
+		return
+	default:
+		_, err = app.models.Tokens.NewWithEmail(r.Context(), user.ID, 24*time.Hour, models.ScopeDeletion, func(token *models.Token) (*models.Email, error) {
+			return app.newEmail(user.Email, user.Locale, mail.DeletionData{Token: token.Plaintext})
+		})
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
+			return
 		}
-		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, models.ScopeDeletion)
+	env := envelope{"message": i18n.T(app.locale(r), "an email will be sent to you containing deletion instructions")}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	app.background(func() {
-		models := map[string]interface{}{
-			"deletionToken": token.Plaintext,
-		}
+// allowTokenRequest enforces the per-email and per-IP quotas of the endpoints
+// that send tokens by email. It sends the error response itself and returns
+// false if the request must not continue.
+func (app *application) allowTokenRequest(w http.ResponseWriter, r *http.Request, email string) bool {
+	ok, err := app.models.Quotas.AllowTokenRequest(r.Context(), email, clientIP(r), app.config.tokenQuota)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
 
-		err = app.mailer.Send(user.Email, "user_deletion.tmpl", models)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
+	if !ok {
+		w.Header().Set("Retry-After", strconv.Itoa(int(app.config.tokenQuota.Window.Seconds())))
+		app.tooManyRequests(w, r)
+		return false
+	}
 
-	env := envelope{"message": "an email will be sent to you containing deletion instructions"}
-	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	return true
+}
+
+func (app *application) createChallengeHandler(w http.ResponseWriter, r *http.Request) {
+	c, err := app.pow.New()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"challenge": c}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
@@ -0,0 +1,312 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/models"
+	"github.com/Li-Elias/Railclone/internal/totp"
+	"github.com/Li-Elias/Railclone/internal/validator"
+)
+
+const (
+	totpIssuer   = "Railclone"
+	totpHeader   = "X-TOTP-Code"
+	twoFactorTTL = 15 * time.Minute
+
+	// twoFactorMaxAttempts is the number of wrong codes in a row after which
+	// the two-factor tokens of the user are revoked.
+	twoFactorMaxAttempts = 5
+)
+
+// twoFactorEnabled returns the enabled TOTP secret of the user, or nil if the
+// user has not enabled two-factor authentication.
+func (app *application) twoFactorEnabled(ctx context.Context, userID int64) (*models.TOTP, error) {
+	t, err := app.models.TOTP.Get(ctx, userID)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if !t.Enabled {
+		return nil, nil
+	}
+
+	return t, nil
+}
+
+// verifySecondFactor accepts either a TOTP code, which can only be used once,
+// or one of the recovery codes of the user.
+func (app *application) verifySecondFactor(ctx context.Context, t *models.TOTP, code string) (bool, error) {
+	if len(code) == totp.Digits {
+		step, ok := totp.Verify(t.Secret, code, time.Now())
+		if !ok {
+			return false, nil
+		}
+
+		err := app.models.TOTP.UseStep(ctx, t.UserID, step)
+		if err != nil {
+			if errors.Is(err, models.ErrTOTPReplay) {
+				return false, nil
+			}
+			return false, err
+		}
+
+		return true, nil
+	}
+
+	err := app.models.TOTP.UseRecoveryCode(ctx, t.UserID, code)
+	if err != nil {
+		if errors.Is(err, models.ErrRecordNotFound) {
+			return false, nil
+		}
+		return false, err
+	}
+
+	return true, nil
+}
+
+// checkSecondFactor verifies the X-TOTP-Code header for users with two-factor
+// authentication enabled. It sends the error response itself and returns
+// false if the request must not continue.
+func (app *application) checkSecondFactor(w http.ResponseWriter, r *http.Request, user *models.User) bool {
+	t, err := app.twoFactorEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if t == nil {
+		return true
+	}
+
+	ok, err := app.verifySecondFactor(r.Context(), t, r.Header.Get(totpHeader))
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return false
+	}
+
+	if !ok {
+		app.secondFactorRequiredResponse(w, r)
+		return false
+	}
+
+	return true
+}
+
+func (app *application) enrolTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	secret, err := totp.GenerateSecret()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enrol(r.Context(), user.ID, secret)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrEditConflict):
+			v := validator.New()
+			v.AddError("totp", "two-factor authentication is already enabled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	env := envelope{
+		"totp": map[string]string{
+			"secret": secret,
+			"uri":    totp.URI(totpIssuer, user.Email, secret),
+		},
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Code string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	t, err := app.models.TOTP.Get(r.Context(), user.ID)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("totp", "two-factor authentication has not been enrolled")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	if t.Enabled {
+		v.AddError("totp", "two-factor authentication is already enabled")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	step, ok := totp.Verify(t.Secret, input.Code, time.Now())
+	if !ok {
+		v.AddError("code", "invalid two-factor code")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	recoveryCodes, err := models.GenerateRecoveryCodes()
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.TOTP.Enable(r.Context(), user.ID, step, recoveryCodes)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrEditConflict):
+			app.editConflictResponse(w, r)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"recovery_codes": recoveryCodes}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) disableTOTPHandler(w http.ResponseWriter, r *http.Request) {
+	user := app.contextGetUser(r)
+
+	err := app.models.TOTP.Disable(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": i18n.T(app.locale(r), "two-factor authentication disabled")}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) createTwoFactorAuthenticationTokenHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+		Code           string `json:"code"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	models.ValidateTokenPlaintext(v, input.TokenPlaintext)
+	v.Check(input.Code != "", "code", "must be provided")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.GetForToken(r.Context(), models.ScopeTwoFactor, input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired two-factor token")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
+		return
+	}
+
+	t, err := app.twoFactorEnabled(r.Context(), user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	if t != nil {
+		ok, err := app.verifySecondFactor(r.Context(), t, input.Code)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+
+		if !ok {
+			exceeded, err := app.models.TOTP.FailAttempt(r.Context(), user.ID, twoFactorMaxAttempts)
+			if err != nil {
+				app.serverErrorResponse(w, r, err)
+				return
+			}
+
+			if exceeded {
+				err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeTwoFactor, user.ID)
+				if err != nil {
+					app.serverErrorResponse(w, r, err)
+					return
+				}
+
+				v.AddError("token", "too many invalid two-factor codes, request a new token")
+				app.failedValidationResponse(w, r, v.Errors)
+				return
+			}
+
+			v.AddError("code", "invalid two-factor code")
+			app.failedValidationResponse(w, r, v.Errors)
+			return
+		}
+
+		err = app.models.TOTP.ResetFailedAttempts(r.Context(), user.ID)
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeTwoFactor, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 2*time.Hour, models.ScopeAuthentication)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.writeJSON(w, http.StatusCreated, envelope{"token": token, "user": user}, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
@@ -1,10 +1,14 @@
 package main
 
 import (
+	"context"
 	"errors"
 	"net/http"
+	"strings"
 	"time"
 
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/mail"
 	"github.com/Li-Elias/Railclone/internal/models"
 	"github.com/Li-Elias/Railclone/internal/validator"
 )
@@ -23,6 +27,7 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 	user := &models.User{
 		Email:     input.Email,
 		Activated: false,
+		Locale:    i18n.Match(r.Header.Get("Accept-Language")),
 	}
 
 	v := validator.New()
@@ -31,39 +36,54 @@ func (app *application) registerUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Users.Insert(user)
-	if err != nil {
-		switch {
-		case errors.Is(err, models.ErrDuplicateEmail):
-			v.AddError("email", "a user with this email address already exists")
-			app.failedValidationResponse(w, r, v.Errors)
-		default:
+	if !app.allowTokenRequest(w, r, user.Email) {
+		return
+	}
+
+	// a taken address gets the same response as a new one, so that it does
+	// not reveal which addresses are registered; its owner is told instead
+	err = app.models.Users.Insert(r.Context(), user)
+	switch {
+	case errors.Is(err, models.ErrDuplicateEmail):
+		err = app.sendRegistrationNotice(r.Context(), user.Email)
+		if err != nil {
 			app.serverErrorResponse(w, r, err)
+			return
 		}
+	case err != nil:
+		app.serverErrorResponse(w, r, err)
 		return
+	default:
+		_, err = app.models.Tokens.NewWithEmail(r.Context(), user.ID, 24*time.Hour, models.ScopeActivation, func(token *models.Token) (*models.Email, error) {
+			return app.newEmail(user.Email, user.Locale, mail.ActivationData{Token: token.Plaintext})
+		})
+		if err != nil {
+			app.serverErrorResponse(w, r, err)
+			return
+		}
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 24*time.Hour, models.ScopeActivation)
+	env := envelope{"message": i18n.T(app.locale(r), "an email will be sent to you containing activation instructions")}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
-		return
 	}
+}
 
-	app.background(func() {
-		data := map[string]interface{}{
-			"activationToken": token.Plaintext,
-		}
-
-		err = app.mailer.Send(user.Email, "mail.tmpl", data)
-		if err != nil {
-			app.logger.PrintError(err, nil)
-		}
-	})
+// sendRegistrationNotice tells the owner of a registered address that someone
+// tried to sign up with it.
+func (app *application) sendRegistrationNotice(ctx context.Context, email string) error {
+	user, err := app.models.Users.GetByEmail(ctx, email)
+	if err != nil {
+		return err
+	}
 
-	err = app.writeJSON(w, http.StatusAccepted, envelope{"user": user}, nil)
+	notice, err := app.newEmail(user.Email, user.Locale, mail.RegistrationNoticeData{})
 	if err != nil {
-		app.serverErrorResponse(w, r, err)
+		return err
 	}
+
+	return app.models.Outbox.Insert(ctx, notice)
 }
 
 func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Request) {
@@ -83,7 +103,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(models.ScopeActivation, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), models.ScopeActivation, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
@@ -97,7 +117,7 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 
 	user.Activated = true
 
-	err = app.models.Users.Update(user)
+	err = app.models.Users.Update(r.Context(), user)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrEditConflict):
@@ -108,13 +128,13 @@ func (app *application) activateUserHandler(w http.ResponseWriter, r *http.Reque
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(models.ScopeActivation, user.ID)
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeActivation, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	token, err := app.models.Tokens.New(user.ID, 2*time.Hour, models.ScopeAuthentication)
+	token, err := app.models.Tokens.New(r.Context(), user.ID, 2*time.Hour, models.ScopeAuthentication)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
@@ -143,7 +163,7 @@ func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	user, err := app.models.Users.GetForToken(models.ScopeDeletion, input.TokenPlaintext)
+	user, err := app.models.Users.GetForToken(r.Context(), models.ScopeDeletion, input.TokenPlaintext)
 	if err != nil {
 		switch {
 		case errors.Is(err, models.ErrRecordNotFound):
@@ -155,19 +175,118 @@ func (app *application) deleteUserHandler(w http.ResponseWriter, r *http.Request
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(models.ScopeDeletion, user.ID)
+	if !app.checkSecondFactor(w, r, user) {
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeDeletion, user.ID)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	err = app.models.Tokens.DeleteAllForUser(r.Context(), models.ScopeAuthentication, user.ID)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 		return
 	}
 
-	err = app.models.Tokens.DeleteAllForUser(models.ScopeAuthentication, user.ID)
+	err = app.writeJSON(w, http.StatusOK, envelope{"message": i18n.T(app.locale(r), "user successfully deleted")}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) updateUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		Email string `json:"email"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	user := app.contextGetUser(r)
+
+	v := validator.New()
+	models.ValidateEmail(v, input.Email)
+	v.Check(!strings.EqualFold(input.Email, user.Email), "email", "must be different from the current email address")
+	if !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	_, err = app.models.Users.GetByEmail(r.Context(), input.Email)
+	switch {
+	case err == nil:
+		v.AddError("email", "a user with this email address already exists")
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	case !errors.Is(err, models.ErrRecordNotFound):
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	_, err = app.models.Tokens.NewEmailChange(r.Context(), user.ID, 24*time.Hour, input.Email, func(token *models.Token) ([]*models.Email, error) {
+		confirmation, err := app.newEmail(input.Email, user.Locale, mail.EmailChangeData{Token: token.Plaintext})
+		if err != nil {
+			return nil, err
+		}
+
+		notice, err := app.newEmail(user.Email, user.Locale, mail.EmailChangeNoticeData{NewEmail: input.Email})
+		if err != nil {
+			return nil, err
+		}
+
+		return []*models.Email{confirmation, notice}, nil
+	})
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+		return
+	}
+
+	env := envelope{"message": i18n.T(app.locale(r), "an email will be sent to the new address containing confirmation instructions")}
+	err = app.writeJSON(w, http.StatusAccepted, env, nil)
+	if err != nil {
+		app.serverErrorResponse(w, r, err)
+	}
+}
+
+func (app *application) confirmUserEmailHandler(w http.ResponseWriter, r *http.Request) {
+	var input struct {
+		TokenPlaintext string `json:"token"`
+	}
+
+	err := app.readJSON(w, r, &input)
+	if err != nil {
+		app.badRequestResponse(w, r, err)
+		return
+	}
+
+	v := validator.New()
+	if models.ValidateTokenPlaintext(v, input.TokenPlaintext); !v.Valid() {
+		app.failedValidationResponse(w, r, v.Errors)
+		return
+	}
+
+	user, err := app.models.Users.ChangeEmailForToken(r.Context(), input.TokenPlaintext)
+	if err != nil {
+		switch {
+		case errors.Is(err, models.ErrRecordNotFound):
+			v.AddError("token", "invalid or expired email change token")
+			app.failedValidationResponse(w, r, v.Errors)
+		case errors.Is(err, models.ErrDuplicateEmail):
+			v.AddError("email", "a user with this email address already exists")
+			app.failedValidationResponse(w, r, v.Errors)
+		default:
+			app.serverErrorResponse(w, r, err)
+		}
 		return
 	}
 
-	err = app.writeJSON(w, http.StatusOK, envelope{"message": "user successfully deleted"}, nil)
+	err = app.writeJSON(w, http.StatusOK, envelope{"user": user}, nil)
 	if err != nil {
 		app.serverErrorResponse(w, r, err)
 	}
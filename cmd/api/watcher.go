@@ -0,0 +1,18 @@
+package main
+
+import (
+	"context"
+)
+
+func (app *application) runClusterWatcher(ctx context.Context) {
+	properties := map[string]string{
+		"worker": "cluster watcher",
+	}
+
+	err := app.deployments.Watch(ctx, func(err error) {
+		app.logger.PrintError(err, properties)
+	})
+	if err != nil {
+		app.logger.PrintError(err, properties)
+	}
+}
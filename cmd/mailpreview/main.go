@@ -0,0 +1,64 @@
+package main
+
+import (
+	"flag"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+	"github.com/Li-Elias/Railclone/internal/jsonlog"
+	"github.com/Li-Elias/Railclone/internal/mail"
+)
+
+func main() {
+	var out, recipient string
+
+	flag.StringVar(&out, "out", "./mailpreview", "Directory the rendered templates are written to")
+	flag.StringVar(&recipient, "recipient", "preview@example.com", "Recipient shown in the previews")
+	flag.Parse()
+
+	logger := jsonlog.New(os.Stdout, jsonlog.LevelInfo)
+
+	templates, err := mail.ParseTemplates()
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	for _, locale := range i18n.Supported {
+		err = os.MkdirAll(filepath.Join(out, locale), 0o755)
+		if err != nil {
+			logger.PrintFatal(err, nil)
+		}
+
+		for _, data := range mail.Previews() {
+			render(logger, templates, filepath.Join(out, locale), recipient, locale, data)
+		}
+	}
+}
+
+func render(logger *jsonlog.Logger, templates *mail.Templates, dir, recipient, locale string, data mail.Data) {
+	msg, err := templates.Render(recipient, locale, data)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	name := filepath.Join(dir, strings.TrimSuffix(data.Template(), ".tmpl"))
+
+	plain := "To: " + msg.To + "\nSubject: " + msg.Subject + "\n\n" + msg.PlainBody
+	err = os.WriteFile(name+".txt", []byte(plain), 0o644)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	err = os.WriteFile(name+".html", []byte(msg.HTMLBody), 0o644)
+	if err != nil {
+		logger.PrintFatal(err, nil)
+	}
+
+	logger.PrintInfo("rendered mail template", map[string]string{
+		"template": data.Template(),
+		"locale":   locale,
+		"files":    name + ".txt " + name + ".html",
+	})
+}
@@ -0,0 +1,72 @@
+package challenge
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const HeaderCaptcha = "X-Captcha-Response"
+
+// Captcha verifies CAPTCHA responses with the siteverify API that hCaptcha,
+// Cloudflare Turnstile and reCAPTCHA have in common.
+type Captcha struct {
+	verifyURL string
+	secret    string
+	client    *http.Client
+}
+
+func NewCaptcha(verifyURL, secret string) *Captcha {
+	return &Captcha{
+		verifyURL: verifyURL,
+		secret:    secret,
+		client:    &http.Client{Timeout: 5 * time.Second},
+	}
+}
+
+func (c *Captcha) Verify(ctx context.Context, r *http.Request, clientIP string) error {
+	response := r.Header.Get(HeaderCaptcha)
+	if response == "" {
+		return ErrFailed
+	}
+
+	form := url.Values{}
+	form.Set("secret", c.secret)
+	form.Set("response", response)
+	form.Set("remoteip", clientIP)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.verifyURL, strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+
+	res, err := c.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	if res.StatusCode != http.StatusOK {
+		return fmt.Errorf("captcha verification returned %s", res.Status)
+	}
+
+	var result struct {
+		Success bool `json:"success"`
+	}
+
+	err = json.NewDecoder(res.Body).Decode(&result)
+	if err != nil {
+		return err
+	}
+
+	if !result.Success {
+		return ErrFailed
+	}
+
+	return nil
+}
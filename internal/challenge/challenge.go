@@ -0,0 +1,28 @@
+package challenge
+
+import (
+	"context"
+	"errors"
+	"net/http"
+)
+
+const (
+	KindNone        = "none"
+	KindProofOfWork = "pow"
+	KindCaptcha     = "captcha"
+)
+
+var ErrFailed = errors.New("challenge was not solved")
+
+// Verifier checks that a client solved a challenge before it is allowed to
+// make a request that sends an email. The solution is read from the request
+// headers so that the request bodies stay unchanged.
+type Verifier interface {
+	Verify(ctx context.Context, r *http.Request, clientIP string) error
+}
+
+type None struct{}
+
+func (None) Verify(ctx context.Context, r *http.Request, clientIP string) error {
+	return nil
+}
@@ -0,0 +1,126 @@
+package challenge
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/binary"
+	"math/bits"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	HeaderChallenge = "X-Challenge"
+	HeaderNonce     = "X-Challenge-Nonce"
+)
+
+// ProofOfWork issues stateless challenges signed with a secret. A client
+// solves one by finding a nonce for which sha256(challenge + ":" + nonce)
+// starts with Difficulty zero bits. Each challenge is only accepted once.
+type ProofOfWork struct {
+	secret     []byte
+	used       UsedChallenges
+	Difficulty int
+	TTL        time.Duration
+}
+
+// UsedChallenges remembers the challenges that have been accepted until they
+// expire. Use reports whether the challenge had not been used before.
+type UsedChallenges interface {
+	Use(ctx context.Context, id []byte, expiry time.Time) (bool, error)
+}
+
+type Challenge struct {
+	Challenge  string    `json:"challenge"`
+	Difficulty int       `json:"difficulty"`
+	Expiry     time.Time `json:"expiry"`
+}
+
+func NewProofOfWork(secret []byte, used UsedChallenges, difficulty int, ttl time.Duration) *ProofOfWork {
+	return &ProofOfWork{
+		secret:     secret,
+		used:       used,
+		Difficulty: difficulty,
+		TTL:        ttl,
+	}
+}
+
+func (p *ProofOfWork) New() (*Challenge, error) {
+	expiry := time.Now().Add(p.TTL)
+
+	payload := make([]byte, 24)
+	binary.BigEndian.PutUint64(payload, uint64(expiry.Unix()))
+
+	_, err := rand.Read(payload[8:])
+	if err != nil {
+		return nil, err
+	}
+
+	encoded := base64.RawURLEncoding.EncodeToString(payload)
+
+	return &Challenge{
+		Challenge:  encoded + "." + base64.RawURLEncoding.EncodeToString(p.sign(encoded)),
+		Difficulty: p.Difficulty,
+		Expiry:     expiry,
+	}, nil
+}
+
+func (p *ProofOfWork) Verify(ctx context.Context, r *http.Request, clientIP string) error {
+	challenge := r.Header.Get(HeaderChallenge)
+	nonce := r.Header.Get(HeaderNonce)
+
+	encoded, signature, ok := strings.Cut(challenge, ".")
+	if !ok || nonce == "" {
+		return ErrFailed
+	}
+
+	sig, err := base64.RawURLEncoding.DecodeString(signature)
+	if err != nil || !hmac.Equal(sig, p.sign(encoded)) {
+		return ErrFailed
+	}
+
+	payload, err := base64.RawURLEncoding.DecodeString(encoded)
+	if err != nil || len(payload) != 24 {
+		return ErrFailed
+	}
+
+	expiry := time.Unix(int64(binary.BigEndian.Uint64(payload)), 0)
+	if time.Now().After(expiry) {
+		return ErrFailed
+	}
+
+	if leadingZeroBits(sha256.Sum256([]byte(challenge+":"+nonce))) < p.Difficulty {
+		return ErrFailed
+	}
+
+	fresh, err := p.used.Use(ctx, payload, expiry)
+	if err != nil {
+		return err
+	}
+	if !fresh {
+		return ErrFailed
+	}
+
+	return nil
+}
+
+func (p *ProofOfWork) sign(payload string) []byte {
+	mac := hmac.New(sha256.New, p.secret)
+	mac.Write([]byte(payload))
+	return mac.Sum(nil)
+}
+
+func leadingZeroBits(sum [sha256.Size]byte) int {
+	n := 0
+	for _, b := range sum {
+		if b != 0 {
+			return n + bits.LeadingZeros8(b)
+		}
+		n += 8
+	}
+	return n
+}
@@ -13,6 +13,8 @@ type DB struct {
 	MaxOpenConns int
 	MaxIdleConns int
 	MaxIdleTime  string
+	QueryTimeout time.Duration
+	AutoMigrate  bool
 }
 
 func Init(cfg *DB) (*sql.DB, error) {
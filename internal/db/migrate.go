@@ -0,0 +1,297 @@
+package db
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"io/fs"
+	"path"
+	"regexp"
+	"sort"
+	"strconv"
+)
+
+// migrationLockKey is the key of the advisory lock that keeps replicas from
+// migrating the database at the same time.
+const migrationLockKey = 7_351_274_013
+
+var (
+	ErrDirtySchema    = errors.New("database schema is dirty")
+	ErrSchemaMismatch = errors.New("database schema version does not match the application")
+	ErrNoMigration    = errors.New("no migration to roll back")
+
+	migrationFileRX = regexp.MustCompile(`^(\d+)_(.+)\.(up|down)\.sql$`)
+)
+
+type migration struct {
+	version int64
+	name    string
+	up      string
+	down    string
+}
+
+type MigrationStatus struct {
+	Version int64    `json:"version"`
+	Dirty   bool     `json:"dirty"`
+	Latest  int64    `json:"latest"`
+	Pending []string `json:"pending"`
+}
+
+// Migrator applies the SQL migrations of a file system. It keeps its state in
+// the same schema_migrations table as the migrate CLI, so databases that were
+// migrated with the CLI can be picked up as they are.
+type Migrator struct {
+	db         *sql.DB
+	migrations []migration
+}
+
+func NewMigrator(db *sql.DB, fsys fs.FS) (*Migrator, error) {
+	files, err := fs.Glob(fsys, "*.sql")
+	if err != nil {
+		return nil, err
+	}
+
+	byVersion := make(map[int64]*migration)
+
+	for _, file := range files {
+		matches := migrationFileRX.FindStringSubmatch(path.Base(file))
+		if matches == nil {
+			return nil, fmt.Errorf("invalid migration file name %q", file)
+		}
+
+		version, err := strconv.ParseInt(matches[1], 10, 64)
+		if err != nil {
+			return nil, err
+		}
+
+		content, err := fs.ReadFile(fsys, file)
+		if err != nil {
+			return nil, err
+		}
+
+		m, ok := byVersion[version]
+		if !ok {
+			m = &migration{version: version, name: matches[2]}
+			byVersion[version] = m
+		}
+
+		if matches[3] == "up" {
+			m.up = string(content)
+		} else {
+			m.down = string(content)
+		}
+	}
+
+	migrator := &Migrator{db: db}
+	for _, m := range byVersion {
+		migrator.migrations = append(migrator.migrations, *m)
+	}
+	sort.Slice(migrator.migrations, func(i, j int) bool {
+		return migrator.migrations[i].version < migrator.migrations[j].version
+	})
+
+	return migrator, nil
+}
+
+func (m *Migrator) latest() int64 {
+	if len(m.migrations) == 0 {
+		return 0
+	}
+	return m.migrations[len(m.migrations)-1].version
+}
+
+// Up applies every pending migration and returns the names of the applied ones.
+func (m *Migrator) Up(ctx context.Context) ([]string, error) {
+	var applied []string
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtySchema
+		}
+
+		for _, migration := range m.migrations {
+			if migration.version <= version {
+				continue
+			}
+
+			err := m.apply(ctx, conn, migration.up, migration.version)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.version, migration.name, err)
+			}
+
+			applied = append(applied, fmt.Sprintf("%d_%s", migration.version, migration.name))
+		}
+
+		return nil
+	})
+
+	return applied, err
+}
+
+// Down rolls back the most recently applied migration.
+func (m *Migrator) Down(ctx context.Context) (string, error) {
+	var rolledBack string
+
+	err := m.withLock(ctx, func(conn *sql.Conn) error {
+		version, dirty, err := m.version(ctx, conn)
+		if err != nil {
+			return err
+		}
+		if dirty {
+			return ErrDirtySchema
+		}
+
+		for i := len(m.migrations) - 1; i >= 0; i-- {
+			migration := m.migrations[i]
+			if migration.version != version {
+				continue
+			}
+
+			var previous int64
+			if i > 0 {
+				previous = m.migrations[i-1].version
+			}
+
+			err := m.apply(ctx, conn, migration.down, previous)
+			if err != nil {
+				return fmt.Errorf("migration %d_%s: %w", migration.version, migration.name, err)
+			}
+
+			rolledBack = fmt.Sprintf("%d_%s", migration.version, migration.name)
+			return nil
+		}
+
+		return ErrNoMigration
+	})
+
+	return rolledBack, err
+}
+
+func (m *Migrator) Status(ctx context.Context) (*MigrationStatus, error) {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	version, dirty, err := m.version(ctx, conn)
+	if err != nil {
+		return nil, err
+	}
+
+	status := &MigrationStatus{
+		Version: version,
+		Dirty:   dirty,
+		Latest:  m.latest(),
+		Pending: []string{},
+	}
+
+	for _, migration := range m.migrations {
+		if migration.version > version {
+			status.Pending = append(status.Pending, fmt.Sprintf("%d_%s", migration.version, migration.name))
+		}
+	}
+
+	return status, nil
+}
+
+// Check returns ErrSchemaMismatch unless the database is at exactly the
+// version of the newest migration.
+func (m *Migrator) Check(ctx context.Context) error {
+	status, err := m.Status(ctx)
+	if err != nil {
+		return err
+	}
+
+	switch {
+	case status.Dirty:
+		return ErrDirtySchema
+	case status.Version != status.Latest:
+		return fmt.Errorf("%w: database is at %d, application expects %d", ErrSchemaMismatch, status.Version, status.Latest)
+	default:
+		return nil
+	}
+}
+
+func (m *Migrator) withLock(ctx context.Context, fn func(conn *sql.Conn) error) error {
+	conn, err := m.db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.ExecContext(ctx, `SELECT pg_advisory_lock($1)`, migrationLockKey)
+	if err != nil {
+		return err
+	}
+	defer conn.ExecContext(context.WithoutCancel(ctx), `SELECT pg_advisory_unlock($1)`, migrationLockKey)
+
+	_, err = conn.ExecContext(ctx, `
+		CREATE TABLE IF NOT EXISTS schema_migrations (
+			version bigint NOT NULL PRIMARY KEY,
+			dirty boolean NOT NULL
+		)`)
+	if err != nil {
+		return err
+	}
+
+	return fn(conn)
+}
+
+func (m *Migrator) version(ctx context.Context, conn *sql.Conn) (int64, bool, error) {
+	var exists bool
+
+	err := conn.QueryRowContext(ctx, `SELECT to_regclass('schema_migrations') IS NOT NULL`).Scan(&exists)
+	if err != nil || !exists {
+		return 0, false, err
+	}
+
+	var version int64
+	var dirty bool
+
+	err = conn.QueryRowContext(ctx, `SELECT version, dirty FROM schema_migrations LIMIT 1`).Scan(&version, &dirty)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return 0, false, nil
+		default:
+			return 0, false, err
+		}
+	}
+
+	return version, dirty, nil
+}
+
+// apply runs a migration script and records the resulting version in one
+// transaction, so a failed script leaves neither behind.
+func (m *Migrator) apply(ctx context.Context, conn *sql.Conn, script string, version int64) error {
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, script)
+	if err != nil {
+		return err
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM schema_migrations`)
+	if err != nil {
+		return err
+	}
+
+	if version != 0 {
+		_, err = tx.ExecContext(ctx, `INSERT INTO schema_migrations (version, dirty) VALUES ($1, false)`, version)
+		if err != nil {
+			return err
+		}
+	}
+
+	return tx.Commit()
+}
@@ -2,317 +2,349 @@ package deployments
 
 import (
 	"context"
+	"errors"
 	"fmt"
-	"strings"
+	"maps"
 
-	appsv1 "k8s.io/api/apps/v1"
-	corev1 "k8s.io/api/core/v1"
-	"k8s.io/apimachinery/pkg/api/resource"
-	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
-	"k8s.io/apimachinery/pkg/util/intstr"
+	apierrors "k8s.io/apimachinery/pkg/api/errors"
 	"k8s.io/client-go/kubernetes"
-	"k8s.io/client-go/util/retry"
 
 	"github.com/Li-Elias/Railclone/internal/models"
 )
 
-func Create(clientset *kubernetes.Clientset, deployment *models.Deployment) (int32, error) {
-	appName := fmt.Sprintf("deployment-%d-user-%d", deployment.ID, deployment.UserID)
+var ErrDeletionPending = errors.New("deployment deletion is still in progress")
 
-	deploymentObj := &appsv1.Deployment{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: appName + "-deployment",
-		},
-		Spec: appsv1.DeploymentSpec{
-			Replicas: int32Ptr(deployment.Replicas),
-			Selector: &metav1.LabelSelector{
-				MatchLabels: map[string]string{
-					"app": appName,
-				},
+// Notifier is told about the lifecycle events of deployments, such as
+// models.EventDeploymentCreated, once they have happened. It must not block
+// for long and handles its own errors, since the operation cannot be undone.
+type Notifier interface {
+	Notify(ctx context.Context, event string, deployment *models.Deployment)
+}
+
+type Manager struct {
+	clientset kubernetes.Interface
+	models    models.Models
+	notifier  Notifier
+}
+
+func New(clientset kubernetes.Interface, m models.Models, notifier Notifier) *Manager {
+	return &Manager{
+		clientset: clientset,
+		models:    m,
+		notifier:  notifier,
+	}
+}
+
+func (m *Manager) Create(ctx context.Context, deployment *models.Deployment) error {
+	deployment.Status = models.StatusProvisioning
+
+	steps := []step{
+		{
+			name: "record",
+			action: func(ctx context.Context) error {
+				return m.models.Deployments.Insert(ctx, deployment)
 			},
-			Template: corev1.PodTemplateSpec{
-				ObjectMeta: metav1.ObjectMeta{
-					Labels: map[string]string{
-						"app": appName,
-					},
-				},
-				Spec: corev1.PodSpec{
-					Containers: []corev1.Container{
-						{
-							Name:  appName + "-deployment",
-							Image: deployment.Image,
-							Env:   []corev1.EnvVar{},
-						},
-					},
-				},
+			compensate: func(ctx context.Context) error {
+				return m.models.Deployments.DeleteFromUser(ctx, deployment.ID, deployment.UserID)
 			},
 		},
 	}
 
 	if deployment.Volume != 0 {
-		volume := fmt.Sprintf("%dGi", deployment.Volume)
-		storageClassName := appName + "-storage-class"
-
-		pvObj := &corev1.PersistentVolume{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: appName + "-pv",
-				Labels: map[string]string{
-					"type": "local",
-					"app":  appName,
-				},
-			},
-			Spec: corev1.PersistentVolumeSpec{
-				StorageClassName: storageClassName,
-				Capacity: corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(volume),
-				},
-				AccessModes: []corev1.PersistentVolumeAccessMode{
-					corev1.ReadWriteOnce,
+		steps = append(steps,
+			step{
+				name: "persistent-volume",
+				action: func(ctx context.Context) error {
+					return m.createPersistentVolume(ctx, deployment)
 				},
-				PersistentVolumeSource: corev1.PersistentVolumeSource{
-					HostPath: &corev1.HostPathVolumeSource{
-						Path: fmt.Sprintf("/mnt/%s/data", appName),
-					},
+				compensate: func(ctx context.Context) error {
+					return m.deletePersistentVolume(ctx, deployment)
 				},
 			},
-		}
-
-		pvcObj := &corev1.PersistentVolumeClaim{
-			ObjectMeta: metav1.ObjectMeta{
-				Name: appName + "-pv-claim",
-				Labels: map[string]string{
-					"app": appName,
+			step{
+				name: "persistent-volume-claim",
+				action: func(ctx context.Context) error {
+					return m.createPersistentVolumeClaim(ctx, deployment)
 				},
-			},
-			Spec: corev1.PersistentVolumeClaimSpec{
-				StorageClassName: &storageClassName,
-				AccessModes: []corev1.PersistentVolumeAccessMode{
-					corev1.ReadWriteOnce,
-				},
-				Resources: corev1.ResourceRequirements{
-					Requests: corev1.ResourceList{
-						corev1.ResourceStorage: resource.MustParse(volume),
-					},
-				},
-			},
-		}
-
-		deploymentObj.Spec.Template.Spec.Containers[0].VolumeMounts = append(
-			deploymentObj.Spec.Template.Spec.Containers[0].VolumeMounts,
-			corev1.VolumeMount{
-				Name:      appName + "-volume",
-				MountPath: "/var/lib/" + appName + "-volume" + "/data",
-			},
-		)
-
-		deploymentObj.Spec.Template.Spec.Volumes = append(
-			deploymentObj.Spec.Template.Spec.Volumes,
-			corev1.Volume{
-				Name: appName + "-volume",
-				VolumeSource: corev1.VolumeSource{
-					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
-						ClaimName: appName + "-pv-claim",
-					},
+				compensate: func(ctx context.Context) error {
+					return m.deletePersistentVolumeClaim(ctx, deployment)
 				},
 			},
 		)
-
-		_, err := clientset.CoreV1().PersistentVolumes().Create(context.TODO(), pvObj, metav1.CreateOptions{})
-		if err != nil {
-			panic(err.Error())
-		}
-
-		_, err = clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault).Create(context.TODO(), pvcObj, metav1.CreateOptions{})
-		if err != nil {
-			panic(err.Error())
-		}
-	}
-
-	if len(deployment.EnvVars) != 0 {
-		for key, value := range deployment.EnvVars {
-			deploymentObj.Spec.Template.Spec.Containers[0].Env = append(
-				deploymentObj.Spec.Template.Spec.Containers[0].Env,
-				corev1.EnvVar{Name: key, Value: value},
-			)
-		}
 	}
 
-	serviceObj := &corev1.Service{
-		ObjectMeta: metav1.ObjectMeta{
-			Name: appName + "-service",
+	steps = append(steps,
+		step{
+			name: "deployment",
+			action: func(ctx context.Context) error {
+				return m.createDeployment(ctx, deployment)
+			},
+			compensate: func(ctx context.Context) error {
+				return m.deleteDeployment(ctx, deployment)
+			},
 		},
-		Spec: corev1.ServiceSpec{
-			Selector: map[string]string{
-				"app": appName,
+		step{
+			name: "service",
+			action: func(ctx context.Context) error {
+				return m.createService(ctx, deployment)
 			},
-			Type: corev1.ServiceTypeNodePort,
-			Ports: []corev1.ServicePort{
-				{
-					Port:       5432,
-					Protocol:   corev1.ProtocolTCP,
-					TargetPort: intstr.FromInt(5432),
-				},
+			compensate: func(ctx context.Context) error {
+				return m.deleteService(ctx, deployment)
 			},
 		},
-	}
+		step{
+			name: "ready",
+			action: func(ctx context.Context) error {
+				deployment.Status = models.StatusReady
 
-	_, err := clientset.AppsV1().Deployments(corev1.NamespaceDefault).Create(context.TODO(), deploymentObj, metav1.CreateOptions{})
-	if err != nil {
-		return 0, err
-	}
+				updated, err := m.models.Deployments.UpdateFromUser(ctx, deployment.ID, deployment.UserID, deployment)
+				if err != nil {
+					return err
+				}
 
-	createdService, err := clientset.CoreV1().Services(corev1.NamespaceDefault).Create(context.TODO(), serviceObj, metav1.CreateOptions{})
+				*deployment = *updated
+				return nil
+			},
+		},
+	)
+
+	err := m.run(ctx, deployment, "create", steps)
 	if err != nil {
-		return 0, err
+		return err
 	}
 
-	return createdService.Spec.Ports[0].NodePort, nil
+	m.notifier.Notify(ctx, models.EventDeploymentCreated, deployment)
+	return nil
 }
 
-func Update(clientset *kubernetes.Clientset, deployment *models.Deployment, updatedDeployment *models.Deployment) error {
-	deploymentsClient := clientset.AppsV1().Deployments(corev1.NamespaceDefault)
-	servicesClient := clientset.CoreV1().Services(corev1.NamespaceDefault)
+func deploymentChanged(deployment, updatedDeployment *models.Deployment) bool {
+	return deployment.Replicas != updatedDeployment.Replicas ||
+		deployment.Running != updatedDeployment.Running ||
+		!maps.Equal(deployment.EnvVars, updatedDeployment.EnvVars)
+}
 
-	appName := fmt.Sprintf("deployment-%d-user-%d", deployment.ID, deployment.UserID)
+// Update claims the new version of the deployment record before touching the
+// cluster, so that a concurrent update of the same version fails with
+// models.ErrEditConflict instead of racing it in Kubernetes. Only the
+// Kubernetes objects affected by the changed fields are updated. A deployment
+// that is being deleted cannot be updated and returns ErrDeletionPending.
+func (m *Manager) Update(ctx context.Context, deployment *models.Deployment, updatedDeployment *models.Deployment) (*models.Deployment, error) {
+	if deployment.Status == models.StatusDeleting {
+		return nil, ErrDeletionPending
+	}
 
-	err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		deploymentObj, err := deploymentsClient.Get(context.TODO(), appName+"-deployment", metav1.GetOptions{})
-		if err != nil {
-			return err
-		}
-		if updatedDeployment.Running {
-			deploymentObj.Spec.Replicas = int32Ptr(updatedDeployment.Replicas)
-		} else {
-			deploymentObj.Spec.Replicas = int32Ptr(0)
-		}
+	var result *models.Deployment
 
-		if deployment.Volume != 0 && updatedDeployment.Volume != 0 && deployment.Volume != updatedDeployment.Volume {
-			persistentVolumesClient := clientset.CoreV1().PersistentVolumes()
-			persistentVolumeClaimsClient := clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault)
+	steps := []step{
+		{
+			name: "record",
+			action: func(ctx context.Context) error {
+				updatedDeployment.Status = models.StatusUpdating
+				updatedDeployment.Version = deployment.Version
 
-			volume := fmt.Sprintf("%dGi", updatedDeployment.Volume)
+				var err error
+				result, err = m.models.Deployments.UpdateFromUser(ctx, deployment.ID, deployment.UserID, updatedDeployment)
+				return err
+			},
+			compensate: func(ctx context.Context) error {
+				previous := *deployment
+				previous.Version = result.Version
 
-			err := retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				pvObj, err := persistentVolumesClient.Get(context.TODO(), appName+"-pv", metav1.GetOptions{})
-				if err != nil {
-					return err
-				}
+				_, err := m.models.Deployments.UpdateFromUser(ctx, deployment.ID, deployment.UserID, &previous)
+				return err
+			},
+		},
+	}
 
-				pvObj.Spec.Capacity = corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(volume),
-				}
+	if deploymentChanged(deployment, updatedDeployment) {
+		steps = append(steps, step{
+			name: "deployment",
+			action: func(ctx context.Context) error {
+				return m.updateDeployment(ctx, updatedDeployment)
+			},
+			compensate: func(ctx context.Context) error {
+				return m.updateDeployment(ctx, deployment)
+			},
+		})
+	}
 
-				_, err = persistentVolumesClient.Update(context.TODO(), pvObj, metav1.UpdateOptions{})
-				if err != nil {
-					return err
-				}
+	if deployment.Volume != 0 && updatedDeployment.Volume != 0 && deployment.Volume != updatedDeployment.Volume {
+		steps = append(steps,
+			step{
+				name: "persistent-volume",
+				action: func(ctx context.Context) error {
+					return m.resizePersistentVolume(ctx, updatedDeployment)
+				},
+				compensate: func(ctx context.Context) error {
+					return m.resizePersistentVolume(ctx, deployment)
+				},
+			},
+			step{
+				name: "persistent-volume-claim",
+				action: func(ctx context.Context) error {
+					return m.resizePersistentVolumeClaim(ctx, updatedDeployment)
+				},
+				compensate: func(ctx context.Context) error {
+					return m.resizePersistentVolumeClaim(ctx, deployment)
+				},
+			},
+		)
+	}
 
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	if deployment.Port != updatedDeployment.Port {
+		steps = append(steps, step{
+			name: "service",
+			action: func(ctx context.Context) error {
+				return m.updateServicePort(ctx, updatedDeployment)
+			},
+			compensate: func(ctx context.Context) error {
+				return m.updateServicePort(ctx, deployment)
+			},
+		})
+	}
 
-			err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-				pvcObj, err := persistentVolumeClaimsClient.Get(context.TODO(), appName+"-pv-claim", metav1.GetOptions{})
+	steps = append(steps,
+		step{
+			name: "ready",
+			action: func(ctx context.Context) error {
+				// a deletion that started in the meantime keeps its status
+				swapped, err := m.models.Deployments.SwapStatus(ctx, deployment.ID, models.StatusUpdating, models.StatusReady)
 				if err != nil {
 					return err
 				}
 
-				pvcObj.Spec.Resources.Requests = corev1.ResourceList{
-					corev1.ResourceStorage: resource.MustParse(volume),
+				if swapped {
+					result.Status = models.StatusReady
 				}
+				return nil
+			},
+		},
+	)
 
-				_, err = persistentVolumeClaimsClient.Update(context.TODO(), pvcObj, metav1.UpdateOptions{})
-				if err != nil {
-					return err
-				}
+	err := m.run(ctx, deployment, "update", steps)
+	if err != nil {
+		return nil, err
+	}
 
-				return nil
-			})
-			if err != nil {
-				return err
-			}
+	m.notifier.Notify(ctx, models.EventDeploymentUpdated, result)
+	return result, nil
+}
+
+// Delete removes the Kubernetes objects of a deployment and then its record.
+// It is safe to call repeatedly: objects that are already gone count as
+// deleted, every object is attempted even if another one fails, and the record
+// is only removed once the cluster no longer has any of the objects. Until
+// then the deployment keeps the deleting status so that Sweep can retry.
+func (m *Manager) Delete(ctx context.Context, deployment *models.Deployment) error {
+	if deployment.Status != models.StatusDeleting {
+		err := m.models.Deployments.UpdateStatus(ctx, deployment.ID, models.StatusDeleting)
+		if err != nil && !errors.Is(err, models.ErrRecordNotFound) {
+			return err
 		}
+		deployment.Status = models.StatusDeleting
 
-		if len(updatedDeployment.EnvVars) != 0 {
-			env_vars := []corev1.EnvVar{}
+		m.notifier.Notify(ctx, models.EventDeploymentStatusChanged, deployment)
+	}
 
-			for _, env := range deployment.EnvVars {
-				parts := strings.Split(env, "=")
+	objects := m.objects(deployment)
 
-				if len(parts) == 2 {
-					key := parts[0]
-					value := parts[1]
+	var errs []error
 
-					env_vars = append(
-						env_vars,
-						corev1.EnvVar{Name: key, Value: value},
-					)
-				}
-			}
-			deploymentObj.Spec.Template.Spec.Containers[0].Env = env_vars
+	for _, obj := range objects {
+		err := obj.delete(ctx)
+		if err != nil && !apierrors.IsNotFound(err) {
+			err = fmt.Errorf("delete %s: %w", obj.name, err)
+			errs = append(errs, err, m.record(ctx, deployment, "delete", obj.name, models.StepFailed, err))
+			continue
 		}
 
-		_, err = deploymentsClient.Update(context.TODO(), deploymentObj, metav1.UpdateOptions{})
-		if err != nil {
-			return err
-		}
+		errs = append(errs, m.record(ctx, deployment, "delete", obj.name, models.StepCompleted, nil))
+	}
 
-		return nil
-	})
-	if err != nil {
+	if err := errors.Join(errs...); err != nil {
 		return err
 	}
 
-	err = retry.RetryOnConflict(retry.DefaultRetry, func() error {
-		serviceObj, err := servicesClient.Get(context.TODO(), appName+"-service", metav1.GetOptions{})
-		if err != nil {
-			return err
+	for _, obj := range objects {
+		err := obj.get(ctx)
+		switch {
+		case apierrors.IsNotFound(err):
+			continue
+		case err != nil:
+			return fmt.Errorf("get %s: %w", obj.name, err)
+		default:
+			return ErrDeletionPending
 		}
+	}
 
-		serviceObj.Spec.Ports[0].NodePort = updatedDeployment.Port
+	err := m.models.Deployments.DeleteFromUser(ctx, deployment.ID, deployment.UserID)
+	switch {
+	case errors.Is(err, models.ErrRecordNotFound):
+		// deleted concurrently, which has already notified
+	case err != nil:
+		return err
+	default:
+		m.notifier.Notify(ctx, models.EventDeploymentDeleted, deployment)
+	}
 
-		_, err = servicesClient.Update(context.TODO(), serviceObj, metav1.UpdateOptions{})
-		if err != nil {
-			return err
-		}
+	return m.record(ctx, deployment, "delete", "record", models.StepCompleted, nil)
+}
 
-		return nil
-	})
+// Sweep retries the deletion of every deployment that is still marked as
+// deleting.
+func (m *Manager) Sweep(ctx context.Context) error {
+	deployments, err := m.models.Deployments.GetAllByStatus(ctx, models.StatusDeleting)
 	if err != nil {
 		return err
 	}
 
-	return nil
+	var errs []error
+
+	for _, deployment := range deployments {
+		err := m.Delete(ctx, deployment)
+		if err != nil && !errors.Is(err, ErrDeletionPending) {
+			errs = append(errs, fmt.Errorf("deployment %d: %w", deployment.ID, err))
+		}
+	}
+
+	return errors.Join(errs...)
 }
 
-func Delete(clientset *kubernetes.Clientset, id int64, userID int64) error {
-	appName := fmt.Sprintf("deployment-%d-user-%d", id, userID)
+// Suspend scales every deployment of a user to zero replicas without changing
+// their records, so that Resume can restore them as they were.
+func (m *Manager) Suspend(ctx context.Context, userID int64) error {
+	return m.scaleAll(ctx, userID, "suspend", func(deployment *models.Deployment) *int32 {
+		return int32Ptr(0)
+	})
+}
 
-	deletePolicy := metav1.DeletePropagationForeground
+// Resume scales every deployment of a user back to the replicas in its record.
+func (m *Manager) Resume(ctx context.Context, userID int64) error {
+	return m.scaleAll(ctx, userID, "resume", replicas)
+}
 
-	err := clientset.CoreV1().PersistentVolumes().Delete(context.TODO(), appName+"-pv", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+func (m *Manager) scaleAll(ctx context.Context, userID int64, operation string, replicas func(*models.Deployment) *int32) error {
+	deployments, err := m.models.Deployments.GetAllForUser(ctx, userID)
 	if err != nil {
 		return err
 	}
 
-	err = clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault).Delete(context.TODO(), appName+"-pv-claim", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
-	if err != nil {
-		return err
-	}
+	var errs []error
 
-	err = clientset.CoreV1().Services(corev1.NamespaceDefault).Delete(context.TODO(), appName+"-service", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
-	if err != nil {
-		return err
-	}
+	for _, deployment := range deployments {
+		if deployment.Status == models.StatusDeleting {
+			continue
+		}
 
-	err = clientset.AppsV1().Deployments(corev1.NamespaceDefault).Delete(context.TODO(), appName+"-deployment", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
-	if err != nil {
-		return err
+		err := m.scaleDeployment(ctx, deployment, replicas(deployment))
+		if err != nil && !apierrors.IsNotFound(err) {
+			err = fmt.Errorf("deployment %d: %w", deployment.ID, err)
+			errs = append(errs, err, m.record(ctx, deployment, operation, "deployment", models.StepFailed, err))
+			continue
+		}
+
+		errs = append(errs, m.record(ctx, deployment, operation, "deployment", models.StepCompleted, nil))
 	}
 
-	return nil
+	return errors.Join(errs...)
 }
-
-func int32Ptr(i int32) *int32 { return &i }
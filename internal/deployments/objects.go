@@ -0,0 +1,399 @@
+package deployments
+
+import (
+	"context"
+	"fmt"
+	"sort"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	"k8s.io/apimachinery/pkg/api/resource"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/apimachinery/pkg/util/intstr"
+	"k8s.io/client-go/util/retry"
+
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+func appName(deployment *models.Deployment) string {
+	return fmt.Sprintf("deployment-%d-user-%d", deployment.ID, deployment.UserID)
+}
+
+func volumeQuantity(volume int32) (resource.Quantity, error) {
+	return resource.ParseQuantity(fmt.Sprintf("%dGi", volume))
+}
+
+func replicas(deployment *models.Deployment) *int32 {
+	if !deployment.Running {
+		return int32Ptr(0)
+	}
+	return int32Ptr(deployment.Replicas)
+}
+
+func envVars(vars map[string]string) []corev1.EnvVar {
+	keys := make([]string, 0, len(vars))
+	for key := range vars {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	env := []corev1.EnvVar{}
+	for _, key := range keys {
+		env = append(env, corev1.EnvVar{Name: key, Value: vars[key]})
+	}
+	return env
+}
+
+func newPersistentVolume(deployment *models.Deployment, quantity resource.Quantity) *corev1.PersistentVolume {
+	name := appName(deployment)
+
+	return &corev1.PersistentVolume{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name + "-pv",
+			Labels: map[string]string{
+				"type": "local",
+				"app":  name,
+			},
+		},
+		Spec: corev1.PersistentVolumeSpec{
+			StorageClassName: name + "-storage-class",
+			Capacity: corev1.ResourceList{
+				corev1.ResourceStorage: quantity,
+			},
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			PersistentVolumeSource: corev1.PersistentVolumeSource{
+				HostPath: &corev1.HostPathVolumeSource{
+					Path: fmt.Sprintf("/mnt/%s/data", name),
+				},
+			},
+		},
+	}
+}
+
+func newPersistentVolumeClaim(deployment *models.Deployment, quantity resource.Quantity) *corev1.PersistentVolumeClaim {
+	name := appName(deployment)
+	storageClassName := name + "-storage-class"
+
+	return &corev1.PersistentVolumeClaim{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name + "-pv-claim",
+			Labels: map[string]string{
+				"app": name,
+			},
+		},
+		Spec: corev1.PersistentVolumeClaimSpec{
+			StorageClassName: &storageClassName,
+			AccessModes: []corev1.PersistentVolumeAccessMode{
+				corev1.ReadWriteOnce,
+			},
+			Resources: corev1.ResourceRequirements{
+				Requests: corev1.ResourceList{
+					corev1.ResourceStorage: quantity,
+				},
+			},
+		},
+	}
+}
+
+func newDeployment(deployment *models.Deployment) *appsv1.Deployment {
+	name := appName(deployment)
+
+	deploymentObj := &appsv1.Deployment{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name + "-deployment",
+			Labels: map[string]string{
+				"app": name,
+			},
+		},
+		Spec: appsv1.DeploymentSpec{
+			Replicas: replicas(deployment),
+			Selector: &metav1.LabelSelector{
+				MatchLabels: map[string]string{
+					"app": name,
+				},
+			},
+			Template: corev1.PodTemplateSpec{
+				ObjectMeta: metav1.ObjectMeta{
+					Labels: map[string]string{
+						"app": name,
+					},
+				},
+				Spec: corev1.PodSpec{
+					Containers: []corev1.Container{
+						{
+							Name:  name + "-deployment",
+							Image: deployment.Image,
+							Env:   envVars(deployment.EnvVars),
+						},
+					},
+				},
+			},
+		},
+	}
+
+	if deployment.Volume != 0 {
+		deploymentObj.Spec.Template.Spec.Containers[0].VolumeMounts = []corev1.VolumeMount{
+			{
+				Name:      name + "-volume",
+				MountPath: "/var/lib/" + name + "-volume" + "/data",
+			},
+		}
+
+		deploymentObj.Spec.Template.Spec.Volumes = []corev1.Volume{
+			{
+				Name: name + "-volume",
+				VolumeSource: corev1.VolumeSource{
+					PersistentVolumeClaim: &corev1.PersistentVolumeClaimVolumeSource{
+						ClaimName: name + "-pv-claim",
+					},
+				},
+			},
+		}
+	}
+
+	return deploymentObj
+}
+
+func newService(deployment *models.Deployment) *corev1.Service {
+	name := appName(deployment)
+
+	return &corev1.Service{
+		ObjectMeta: metav1.ObjectMeta{
+			Name: name + "-service",
+		},
+		Spec: corev1.ServiceSpec{
+			Selector: map[string]string{
+				"app": name,
+			},
+			Type: corev1.ServiceTypeNodePort,
+			Ports: []corev1.ServicePort{
+				{
+					Port:       5432,
+					Protocol:   corev1.ProtocolTCP,
+					TargetPort: intstr.FromInt(5432),
+					NodePort:   deployment.Port,
+				},
+			},
+		},
+	}
+}
+
+func (m *Manager) createPersistentVolume(ctx context.Context, deployment *models.Deployment) error {
+	quantity, err := volumeQuantity(deployment.Volume)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.clientset.CoreV1().PersistentVolumes().Create(ctx, newPersistentVolume(deployment, quantity), metav1.CreateOptions{})
+	return err
+}
+
+func (m *Manager) createPersistentVolumeClaim(ctx context.Context, deployment *models.Deployment) error {
+	quantity, err := volumeQuantity(deployment.Volume)
+	if err != nil {
+		return err
+	}
+
+	_, err = m.clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault).Create(ctx, newPersistentVolumeClaim(deployment, quantity), metav1.CreateOptions{})
+	return err
+}
+
+func (m *Manager) createDeployment(ctx context.Context, deployment *models.Deployment) error {
+	_, err := m.clientset.AppsV1().Deployments(corev1.NamespaceDefault).Create(ctx, newDeployment(deployment), metav1.CreateOptions{})
+	return err
+}
+
+func (m *Manager) createService(ctx context.Context, deployment *models.Deployment) error {
+	createdService, err := m.clientset.CoreV1().Services(corev1.NamespaceDefault).Create(ctx, newService(deployment), metav1.CreateOptions{})
+	if err != nil {
+		return err
+	}
+
+	deployment.Port = createdService.Spec.Ports[0].NodePort
+	return nil
+}
+
+func (m *Manager) updateDeployment(ctx context.Context, deployment *models.Deployment) error {
+	deploymentsClient := m.clientset.AppsV1().Deployments(corev1.NamespaceDefault)
+	name := appName(deployment) + "-deployment"
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deploymentObj, err := deploymentsClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		// Deployments created before they were labelled are labelled now, so
+		// that Watch sees them
+		if deploymentObj.Labels == nil {
+			deploymentObj.Labels = map[string]string{}
+		}
+		deploymentObj.Labels["app"] = appName(deployment)
+
+		deploymentObj.Spec.Replicas = replicas(deployment)
+		deploymentObj.Spec.Template.Spec.Containers[0].Env = envVars(deployment.EnvVars)
+
+		_, err = deploymentsClient.Update(ctx, deploymentObj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (m *Manager) scaleDeployment(ctx context.Context, deployment *models.Deployment, replicas *int32) error {
+	deploymentsClient := m.clientset.AppsV1().Deployments(corev1.NamespaceDefault)
+	name := appName(deployment) + "-deployment"
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		deploymentObj, err := deploymentsClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		deploymentObj.Spec.Replicas = replicas
+
+		_, err = deploymentsClient.Update(ctx, deploymentObj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (m *Manager) resizePersistentVolume(ctx context.Context, deployment *models.Deployment) error {
+	persistentVolumesClient := m.clientset.CoreV1().PersistentVolumes()
+	name := appName(deployment) + "-pv"
+
+	quantity, err := volumeQuantity(deployment.Volume)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvObj, err := persistentVolumesClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		pvObj.Spec.Capacity = corev1.ResourceList{
+			corev1.ResourceStorage: quantity,
+		}
+
+		_, err = persistentVolumesClient.Update(ctx, pvObj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (m *Manager) resizePersistentVolumeClaim(ctx context.Context, deployment *models.Deployment) error {
+	persistentVolumeClaimsClient := m.clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault)
+	name := appName(deployment) + "-pv-claim"
+
+	quantity, err := volumeQuantity(deployment.Volume)
+	if err != nil {
+		return err
+	}
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		pvcObj, err := persistentVolumeClaimsClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		pvcObj.Spec.Resources.Requests = corev1.ResourceList{
+			corev1.ResourceStorage: quantity,
+		}
+
+		_, err = persistentVolumeClaimsClient.Update(ctx, pvcObj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+func (m *Manager) updateServicePort(ctx context.Context, deployment *models.Deployment) error {
+	servicesClient := m.clientset.CoreV1().Services(corev1.NamespaceDefault)
+	name := appName(deployment) + "-service"
+
+	return retry.RetryOnConflict(retry.DefaultRetry, func() error {
+		serviceObj, err := servicesClient.Get(ctx, name, metav1.GetOptions{})
+		if err != nil {
+			return err
+		}
+
+		serviceObj.Spec.Ports[0].NodePort = deployment.Port
+
+		_, err = servicesClient.Update(ctx, serviceObj, metav1.UpdateOptions{})
+		return err
+	})
+}
+
+var deletePolicy = metav1.DeletePropagationForeground
+
+func (m *Manager) deletePersistentVolume(ctx context.Context, deployment *models.Deployment) error {
+	return m.clientset.CoreV1().PersistentVolumes().Delete(ctx, appName(deployment)+"-pv", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+}
+
+func (m *Manager) deletePersistentVolumeClaim(ctx context.Context, deployment *models.Deployment) error {
+	return m.clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault).Delete(ctx, appName(deployment)+"-pv-claim", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+}
+
+func (m *Manager) deleteDeployment(ctx context.Context, deployment *models.Deployment) error {
+	return m.clientset.AppsV1().Deployments(corev1.NamespaceDefault).Delete(ctx, appName(deployment)+"-deployment", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+}
+
+func (m *Manager) deleteService(ctx context.Context, deployment *models.Deployment) error {
+	return m.clientset.CoreV1().Services(corev1.NamespaceDefault).Delete(ctx, appName(deployment)+"-service", metav1.DeleteOptions{PropagationPolicy: &deletePolicy})
+}
+
+// object is a Kubernetes object that belongs to a deployment
+type object struct {
+	name   string
+	delete func(ctx context.Context) error
+	get    func(ctx context.Context) error
+}
+
+// objects returns every object a deployment can own, in the order they have
+// to be deleted in. Objects that were never created are included as well.
+func (m *Manager) objects(deployment *models.Deployment) []object {
+	name := appName(deployment)
+
+	return []object{
+		{
+			name: "service",
+			delete: func(ctx context.Context) error {
+				return m.deleteService(ctx, deployment)
+			},
+			get: func(ctx context.Context) error {
+				_, err := m.clientset.CoreV1().Services(corev1.NamespaceDefault).Get(ctx, name+"-service", metav1.GetOptions{})
+				return err
+			},
+		},
+		{
+			name: "deployment",
+			delete: func(ctx context.Context) error {
+				return m.deleteDeployment(ctx, deployment)
+			},
+			get: func(ctx context.Context) error {
+				_, err := m.clientset.AppsV1().Deployments(corev1.NamespaceDefault).Get(ctx, name+"-deployment", metav1.GetOptions{})
+				return err
+			},
+		},
+		{
+			name: "persistent-volume-claim",
+			delete: func(ctx context.Context) error {
+				return m.deletePersistentVolumeClaim(ctx, deployment)
+			},
+			get: func(ctx context.Context) error {
+				_, err := m.clientset.CoreV1().PersistentVolumeClaims(corev1.NamespaceDefault).Get(ctx, name+"-pv-claim", metav1.GetOptions{})
+				return err
+			},
+		},
+		{
+			name: "persistent-volume",
+			delete: func(ctx context.Context) error {
+				return m.deletePersistentVolume(ctx, deployment)
+			},
+			get: func(ctx context.Context) error {
+				_, err := m.clientset.CoreV1().PersistentVolumes().Get(ctx, name+"-pv", metav1.GetOptions{})
+				return err
+			},
+		},
+	}
+}
+
+func int32Ptr(i int32) *int32 { return &i }
@@ -0,0 +1,88 @@
+package deployments
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+const compensationTimeout = 30 * time.Second
+
+type step struct {
+	name       string
+	action     func(ctx context.Context) error
+	compensate func(ctx context.Context) error
+}
+
+// run executes the steps of an operation in order and records the progress of
+// each of them. When a step fails, the steps that already completed are
+// compensated in reverse order and the combined error is returned.
+func (m *Manager) run(ctx context.Context, deployment *models.Deployment, operation string, steps []step) error {
+	for i, s := range steps {
+		err := s.action(ctx)
+		if err != nil {
+			err = fmt.Errorf("%s %s: %w", operation, s.name, err)
+			return errors.Join(
+				err,
+				m.record(ctx, deployment, operation, s.name, models.StepFailed, err),
+				m.compensate(ctx, deployment, operation, steps[:i]),
+			)
+		}
+
+		err = m.record(ctx, deployment, operation, s.name, models.StepCompleted, nil)
+		if err != nil {
+			return errors.Join(err, m.compensate(ctx, deployment, operation, steps[:i+1]))
+		}
+	}
+
+	return nil
+}
+
+func (m *Manager) compensate(ctx context.Context, deployment *models.Deployment, operation string, steps []step) error {
+	// compensation has to happen even if the request that started the
+	// operation has been canceled
+	ctx, cancel := context.WithTimeout(context.WithoutCancel(ctx), compensationTimeout)
+	defer cancel()
+
+	var errs []error
+
+	for i := len(steps) - 1; i >= 0; i-- {
+		s := steps[i]
+		if s.compensate == nil {
+			continue
+		}
+
+		err := s.compensate(ctx)
+		if err != nil {
+			err = fmt.Errorf("compensate %s %s: %w", operation, s.name, err)
+			errs = append(errs, err, m.record(ctx, deployment, operation, s.name, models.StepCompensationFailed, err))
+			continue
+		}
+
+		errs = append(errs, m.record(ctx, deployment, operation, s.name, models.StepCompensated, nil))
+	}
+
+	return errors.Join(errs...)
+}
+
+func (m *Manager) record(ctx context.Context, deployment *models.Deployment, operation, name, state string, err error) error {
+	// nothing to attach the step to before the database record exists
+	if deployment.ID == 0 {
+		return nil
+	}
+
+	step := &models.DeploymentStep{
+		DeploymentID: deployment.ID,
+		Operation:    operation,
+		Step:         name,
+		State:        state,
+	}
+	if err != nil {
+		step.Error = err.Error()
+	}
+
+	return m.models.DeploymentSteps.Insert(context.WithoutCancel(ctx), step)
+}
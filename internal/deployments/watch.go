@@ -0,0 +1,271 @@
+package deployments
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+
+	appsv1 "k8s.io/api/apps/v1"
+	corev1 "k8s.io/api/core/v1"
+	metav1 "k8s.io/apimachinery/pkg/apis/meta/v1"
+	"k8s.io/client-go/informers"
+	"k8s.io/client-go/tools/cache"
+
+	"github.com/Li-Elias/Railclone/internal/models"
+)
+
+// crashReasons are the container states that mean a deployment is broken
+// rather than starting up.
+var crashReasons = map[string]bool{
+	"CrashLoopBackOff":           true,
+	"ImagePullBackOff":           true,
+	"ErrImagePull":               true,
+	"CreateContainerConfigError": true,
+	"OOMKilled":                  true,
+}
+
+type deploymentState struct {
+	Kind              string `json:"kind"`
+	Name              string `json:"name"`
+	Replicas          int32  `json:"replicas"`
+	ReadyReplicas     int32  `json:"ready_replicas"`
+	AvailableReplicas int32  `json:"available_replicas"`
+}
+
+// available reports whether every replica the deployment wants is available.
+func (s deploymentState) available() bool {
+	return s.Replicas > 0 && s.ReadyReplicas == s.Replicas && s.AvailableReplicas == s.Replicas
+}
+
+type podState struct {
+	Kind     string `json:"kind"`
+	Name     string `json:"name"`
+	Phase    string `json:"phase"`
+	Ready    bool   `json:"ready"`
+	Restarts int32  `json:"restarts"`
+	Reason   string `json:"reason,omitempty"`
+	Deleted  bool   `json:"deleted,omitempty"`
+}
+
+func (s podState) crashed() bool {
+	return crashReasons[s.Reason]
+}
+
+func newDeploymentState(d *appsv1.Deployment) deploymentState {
+	state := deploymentState{
+		Kind:              "Deployment",
+		Name:              d.Name,
+		ReadyReplicas:     d.Status.ReadyReplicas,
+		AvailableReplicas: d.Status.AvailableReplicas,
+	}
+	if d.Spec.Replicas != nil {
+		state.Replicas = *d.Spec.Replicas
+	}
+	return state
+}
+
+func newPodState(pod *corev1.Pod) podState {
+	state := podState{
+		Kind:  "Pod",
+		Name:  pod.Name,
+		Phase: string(pod.Status.Phase),
+	}
+
+	for _, condition := range pod.Status.Conditions {
+		if condition.Type == corev1.PodReady {
+			state.Ready = condition.Status == corev1.ConditionTrue
+		}
+	}
+
+	for _, status := range pod.Status.ContainerStatuses {
+		state.Restarts += status.RestartCount
+
+		switch {
+		case status.State.Waiting != nil && status.State.Waiting.Reason != "":
+			state.Reason = status.State.Waiting.Reason
+		case status.State.Terminated != nil && status.State.Terminated.Reason != "":
+			state.Reason = status.State.Terminated.Reason
+		}
+	}
+
+	return state
+}
+
+// parseAppName returns the IDs of the deployment and of its user from the
+// name returned by appName.
+func parseAppName(name string) (id int64, userID int64, ok bool) {
+	_, err := fmt.Sscanf(name, "deployment-%d-user-%d", &id, &userID)
+	return id, userID, err == nil
+}
+
+// Watch runs informers on the Deployments and Pods labelled with an app name
+// until ctx is done. Every change of their state is recorded as a
+// models.EventDeploymentCluster event. A ready deployment with a crashed pod
+// is marked as failed, and as ready again once all of its replicas are
+// available, which notifies models.EventDeploymentStatusChanged. Errors are
+// passed to handleError, since the informers keep running.
+func (m *Manager) Watch(ctx context.Context, handleError func(error)) error {
+	handle := func(err error) {
+		if err != nil && ctx.Err() == nil {
+			handleError(err)
+		}
+	}
+
+	factory := informers.NewSharedInformerFactoryWithOptions(m.clientset, 0,
+		informers.WithNamespace(corev1.NamespaceDefault),
+		informers.WithTweakListOptions(func(options *metav1.ListOptions) {
+			options.LabelSelector = "app"
+		}),
+	)
+
+	_, err := factory.Apps().V1().Deployments().Informer().AddEventHandler(cache.ResourceEventHandlerFuncs{
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*appsv1.Deployment)
+			if !ok {
+				return
+			}
+			d, ok := newObj.(*appsv1.Deployment)
+			if !ok {
+				return
+			}
+
+			handle(m.deploymentChanged(ctx, d, newDeploymentState(old), newDeploymentState(d)))
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	_, err = factory.Core().V1().Pods().Informer().AddEventHandler(cache.ResourceEventHandlerDetailedFuncs{
+		AddFunc: func(obj interface{}, isInInitialList bool) {
+			pod, ok := obj.(*corev1.Pod)
+			if !ok || isInInitialList {
+				return
+			}
+
+			handle(m.podChanged(ctx, pod, podState{}, newPodState(pod)))
+		},
+		UpdateFunc: func(oldObj, newObj interface{}) {
+			old, ok := oldObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+			pod, ok := newObj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+
+			handle(m.podChanged(ctx, pod, newPodState(old), newPodState(pod)))
+		},
+		DeleteFunc: func(obj interface{}) {
+			if tombstone, ok := obj.(cache.DeletedFinalStateUnknown); ok {
+				obj = tombstone.Obj
+			}
+			pod, ok := obj.(*corev1.Pod)
+			if !ok {
+				return
+			}
+
+			state := newPodState(pod)
+			state.Deleted = true
+			handle(m.podChanged(ctx, pod, newPodState(pod), state))
+		},
+	})
+	if err != nil {
+		return err
+	}
+
+	factory.Start(ctx.Done())
+	defer factory.Shutdown()
+
+	for informer, synced := range factory.WaitForCacheSync(ctx.Done()) {
+		if !synced && ctx.Err() == nil {
+			return fmt.Errorf("informer cache of %v did not sync", informer)
+		}
+	}
+
+	<-ctx.Done()
+	return nil
+}
+
+func (m *Manager) deploymentChanged(ctx context.Context, d *appsv1.Deployment, old, state deploymentState) error {
+	if old == state {
+		return nil
+	}
+
+	id, userID, ok := parseAppName(d.Labels["app"])
+	if !ok {
+		return nil
+	}
+
+	recorded, err := m.recordClusterEvent(ctx, id, userID, "deployment/"+d.Name+"@"+d.ResourceVersion, state)
+	if err != nil || !recorded {
+		return err
+	}
+
+	if state.available() && !old.available() {
+		return m.swapStatus(ctx, id, models.StatusFailed, models.StatusReady)
+	}
+
+	return nil
+}
+
+func (m *Manager) podChanged(ctx context.Context, pod *corev1.Pod, old, state podState) error {
+	if old == state {
+		return nil
+	}
+
+	id, userID, ok := parseAppName(pod.Labels["app"])
+	if !ok {
+		return nil
+	}
+
+	key := "pod/" + pod.Name + "@" + pod.ResourceVersion
+	if state.Deleted {
+		key += "/deleted"
+	}
+
+	recorded, err := m.recordClusterEvent(ctx, id, userID, key, state)
+	if err != nil || !recorded {
+		return err
+	}
+
+	if state.crashed() && !old.crashed() {
+		return m.swapStatus(ctx, id, models.StatusReady, models.StatusFailed)
+	}
+
+	return nil
+}
+
+// recordClusterEvent records a cluster event once per key, and reports
+// whether this call recorded it, so that only one API replica acts on it.
+func (m *Manager) recordClusterEvent(ctx context.Context, id, userID int64, key string, state interface{}) (bool, error) {
+	data, err := json.Marshal(state)
+	if err != nil {
+		return false, err
+	}
+
+	event := &models.DeploymentEvent{
+		UserID:       userID,
+		DeploymentID: id,
+		Type:         models.EventDeploymentCluster,
+		Data:         data,
+	}
+
+	return m.models.DeploymentEvents.InsertOnce(ctx, event, key)
+}
+
+func (m *Manager) swapStatus(ctx context.Context, id int64, old, status string) error {
+	swapped, err := m.models.Deployments.SwapStatus(ctx, id, old, status)
+	if err != nil || !swapped {
+		return err
+	}
+
+	deployment, err := m.models.Deployments.Get(ctx, id)
+	if err != nil {
+		return err
+	}
+
+	m.notifier.Notify(ctx, models.EventDeploymentStatusChanged, deployment)
+	return nil
+}
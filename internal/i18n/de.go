@@ -0,0 +1,83 @@
+package i18n
+
+var german = map[string]string{
+	// cmd/api errors
+	"the server encountered a problem and could not process your request":              "Der Server hat ein Problem festgestellt und konnte Ihre Anfrage nicht verarbeiten",
+	"the server took too long to process your request, please try again":               "Die Verarbeitung Ihrer Anfrage hat zu lange gedauert, bitte versuchen Sie es erneut",
+	"the requested resource could not be found":                                        "Die angeforderte Ressource wurde nicht gefunden",
+	"the %s method is not supported for this resource":                                 "Die Methode %s wird für diese Ressource nicht unterstützt",
+	"invalid authentication credentials":                                               "Ungültige Anmeldedaten",
+	"invalid or missing authentication token":                                          "Ungültiges oder fehlendes Authentifizierungstoken",
+	"you must be authenticated to access this resource":                                "Sie müssen angemeldet sein, um auf diese Ressource zuzugreifen",
+	"unable to update the record due to an edit conflict, please try again":            "Der Datensatz konnte wegen eines Bearbeitungskonflikts nicht aktualisiert werden, bitte versuchen Sie es erneut",
+	"the deployment is being deleted and can no longer be updated":                     "Das Deployment wird gelöscht und kann nicht mehr aktualisiert werden",
+	"the resource has been modified since you last fetched it":                         "Die Ressource wurde seit Ihrem letzten Abruf geändert",
+	"this request must include an If-Match header with the resource's ETag":            "Diese Anfrage muss einen If-Match-Header mit dem ETag der Ressource enthalten",
+	"the request body must be of type %s":                                              "Der Anfragetext muss vom Typ %s sein",
+	"your user account must be activated to access this resource":                      "Ihr Benutzerkonto muss aktiviert sein, um auf diese Ressource zuzugreifen",
+	"the identity provider has not verified your email address":                        "Der Identitätsanbieter hat Ihre E-Mail-Adresse nicht bestätigt",
+	"this action requires a valid two-factor code in the X-TOTP-Code header":           "Diese Aktion erfordert einen gültigen Zwei-Faktor-Code im X-TOTP-Code-Header",
+	"two-factor authentication disabled":                                               "Zwei-Faktor-Authentifizierung deaktiviert",
+	"your user account has been suspended":                                             "Ihr Benutzerkonto wurde gesperrt",
+	"your user account doesn't have the necessary permissions to access this resource": "Ihr Benutzerkonto hat nicht die nötigen Berechtigungen, um auf diese Ressource zuzugreifen",
+	"this request requires a solved challenge":                                         "Diese Anfrage erfordert eine gelöste Aufgabe",
+	"too many requests":                                                             "Zu viele Anfragen",
+	"one or more fields are invalid":                                                "Ein oder mehrere Felder sind ungültig",
+	"body contains badly-formed JSON":                                               "Der Anfragetext enthält fehlerhaftes JSON",
+	"body contains badly-formed JSON (at character %d)":                             "Der Anfragetext enthält fehlerhaftes JSON (bei Zeichen %d)",
+	"body contains incorrect JSON type for field %q":                                "Der Anfragetext enthält einen falschen JSON-Typ für das Feld %q",
+	"body contains incorrect JSON type (at character %d)":                           "Der Anfragetext enthält einen falschen JSON-Typ (bei Zeichen %d)",
+	"body contains unknown key %s":                                                  "Der Anfragetext enthält den unbekannten Schlüssel %s",
+	"body must not be larger than %d bytes":                                         "Der Anfragetext darf nicht größer als %d Bytes sein",
+	"invalid Last-Event-ID header":                                                  "Ungültiger Last-Event-ID-Header",
+	"body must not be empty":                                                        "Der Anfragetext darf nicht leer sein",
+	"body must only contain a single JSON value":                                    "Der Anfragetext darf nur einen einzigen JSON-Wert enthalten",
+	"an email will be sent to you containing activation instructions":               "Sie erhalten eine E-Mail mit Anweisungen zur Aktivierung",
+	"an email will be sent to you containing authentication instructions":           "Sie erhalten eine E-Mail mit Anweisungen zur Anmeldung",
+	"an email will be sent to you containing deletion instructions":                 "Sie erhalten eine E-Mail mit Anweisungen zur Löschung",
+	"an email will be sent to the new address containing confirmation instructions": "An die neue Adresse wird eine E-Mail mit Anweisungen zur Bestätigung gesendet",
+	"user successfully deleted":                                                     "Benutzer erfolgreich gelöscht",
+	"deployment successfully deleted":                                               "Deployment erfolgreich gelöscht",
+	"deployment deletion is in progress":                                            "Das Deployment wird gelöscht",
+	"webhook successfully deleted":                                                  "Webhook erfolgreich gelöscht",
+
+	// validation
+	"must be provided":                                          "muss angegeben werden",
+	"must be a valid email address":                             "muss eine gültige E-Mail-Adresse sein",
+	"must be 26 bytes long":                                     "muss 26 Bytes lang sein",
+	"must be an integer value":                                  "muss eine ganze Zahl sein",
+	"must be a boolean value":                                   "muss ein boolescher Wert sein",
+	"must be greater than zero":                                 "muss größer als null sein",
+	"must be a maximum of 10 million":                           "darf höchstens 10 Millionen sein",
+	"must be a maximum of 100":                                  "darf höchstens 100 sein",
+	"invalid sort value":                                        "ungültiger Sortierwert",
+	"needs to be available":                                     "muss verfügbar sein",
+	"cannot have a negative value":                              "darf nicht negativ sein",
+	"cannot have a value over 5":                                "darf nicht größer als 5 sein",
+	"cannot be added to or removed from an existing deployment": "kann einem bestehenden Deployment nicht hinzugefügt oder entfernt werden",
+	"cannot have a value over 4":                                "darf nicht größer als 4 sein",
+	"not available for this image":                              "ist für dieses Image nicht verfügbar",
+	"needs to have a value of at least 1":                       "muss mindestens 1 sein",
+	"not available or valid":                                    "nicht verfügbar oder ungültig",
+	"cannot have a value under 30000":                           "darf nicht kleiner als 30000 sein",
+	"cannot have a value over 32767":                            "darf nicht größer als 32767 sein",
+	"a user with this email address already exists":             "ein Benutzer mit dieser E-Mail-Adresse existiert bereits",
+	"invalid or expired activation token":                       "ungültiges oder abgelaufenes Aktivierungstoken",
+	"invalid or expired login state":                            "ungültiger oder abgelaufener Anmeldestatus",
+	"two-factor authentication is already enabled":              "die Zwei-Faktor-Authentifizierung ist bereits aktiviert",
+	"two-factor authentication has not been enrolled":           "die Zwei-Faktor-Authentifizierung wurde nicht eingerichtet",
+	"invalid two-factor code":                                   "ungültiger Zwei-Faktor-Code",
+	"too many invalid two-factor codes, request a new token":    "zu viele ungültige Zwei-Faktor-Codes, fordern Sie ein neues Token an",
+	"invalid or expired two-factor token":                       "ungültiges oder abgelaufenes Zwei-Faktor-Token",
+	"must be different from the current email address":          "muss sich von der aktuellen E-Mail-Adresse unterscheiden",
+	"invalid or expired email change token":                     "ungültiges oder abgelaufenes Token zur Änderung der E-Mail-Adresse",
+	"invalid role value":                                        "ungültiger Rollenwert",
+	"invalid status value":                                      "ungültiger Statuswert",
+	"administrators cannot be suspended":                        "Administratoren können nicht gesperrt werden",
+	"user has already been activated":                           "der Benutzer wurde bereits aktiviert",
+	"must not be more than 2048 bytes long":                     "darf nicht länger als 2048 Bytes sein",
+	"must be an absolute http or https URL":                     "muss eine absolute http- oder https-URL sein",
+	"must contain at least 1 event":                             "muss mindestens 1 Ereignis enthalten",
+	"must not contain duplicate values":                         "darf keine doppelten Werte enthalten",
+	"must only contain known events":                            "darf nur bekannte Ereignisse enthalten",
+}
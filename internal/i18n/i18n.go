@@ -0,0 +1,101 @@
+package i18n
+
+import (
+	"fmt"
+	"slices"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	English = "en"
+	German  = "de"
+
+	Default = English
+)
+
+var Supported = []string{English, German}
+
+// catalog maps every supported locale except English to the translations of
+// the English messages, which are used as the keys.
+var catalog = map[string]map[string]string{
+	German: german,
+}
+
+func IsSupported(locale string) bool {
+	return slices.Contains(Supported, locale)
+}
+
+// T translates an English message into the locale and falls back to the
+// message itself when there is no translation.
+func T(locale, message string) string {
+	if translated, ok := catalog[locale][message]; ok {
+		return translated
+	}
+	return message
+}
+
+// Message is an English message with the arguments formatted into it, which
+// is translated before the arguments are formatted into the translation. It
+// is an error, so that functions failing with a message for the client can
+// return it.
+type Message struct {
+	Format string
+	Args   []interface{}
+}
+
+func Messagef(format string, args ...interface{}) *Message {
+	return &Message{Format: format, Args: args}
+}
+
+func (m *Message) Error() string {
+	return fmt.Sprintf(m.Format, m.Args...)
+}
+
+// Translate returns the message in the locale.
+func (m *Message) Translate(locale string) string {
+	return fmt.Sprintf(T(locale, m.Format), m.Args...)
+}
+
+// Match returns the supported locale that an Accept-Language header prefers
+// most, or Default if it does not ask for any of them.
+func Match(acceptLanguage string) string {
+	type tag struct {
+		locale string
+		q      float64
+	}
+
+	var tags []tag
+
+	for _, part := range strings.Split(acceptLanguage, ",") {
+		locale, params, _ := strings.Cut(strings.TrimSpace(part), ";")
+		if locale == "" {
+			continue
+		}
+
+		q := 1.0
+		if value, ok := strings.CutPrefix(strings.TrimSpace(params), "q="); ok {
+			parsed, err := strconv.ParseFloat(value, 64)
+			if err != nil {
+				continue
+			}
+			q = parsed
+		}
+
+		base, _, _ := strings.Cut(strings.ToLower(locale), "-")
+		tags = append(tags, tag{locale: base, q: q})
+	}
+
+	sort.SliceStable(tags, func(i, j int) bool {
+		return tags[i].q > tags[j].q
+	})
+
+	for _, t := range tags {
+		if t.q > 0 && IsSupported(t.locale) {
+			return t.locale
+		}
+	}
+
+	return Default
+}
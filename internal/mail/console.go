@@ -0,0 +1,39 @@
+package mail
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync"
+)
+
+// ConsoleMailer writes the plain text version of every message to a writer,
+// which is handy during local development.
+type ConsoleMailer struct {
+	out    io.Writer
+	sender string
+	mu     sync.Mutex
+}
+
+func NewConsoleMailer(out io.Writer, sender string) *ConsoleMailer {
+	return &ConsoleMailer{
+		out:    out,
+		sender: sender,
+	}
+}
+
+func (m *ConsoleMailer) Send(msg *Message) error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	_, err := fmt.Fprintf(
+		m.out,
+		"From: %s\nTo: %s\nSubject: %s\n\n%s\n%s\n",
+		m.sender,
+		msg.To,
+		msg.Subject,
+		strings.TrimSpace(msg.PlainBody),
+		strings.Repeat("-", 72),
+	)
+	return err
+}
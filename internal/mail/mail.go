@@ -1,78 +1,46 @@
 package mail
 
 import (
-	"bytes"
-	"embed"
-	"html/template"
-	"time"
-
-	"github.com/go-mail/mail/v2"
+	"fmt"
+	"os"
 )
 
-//go:embed "templates"
-var templateFS embed.FS
+const (
+	TransportSMTP    = "smtp"
+	TransportConsole = "console"
+	TransportMaildir = "maildir"
+	TransportMemory  = "memory"
+)
 
-type SMTP struct {
-	Host     string
-	Port     int
-	Username string
-	Password string
-	Sender   string
+type Config struct {
+	Transport string
+	Sender    string
+	Maildir   string
+	SMTP      SMTP
 }
 
-type Mailer struct {
-	dialer *mail.Dialer
-	sender string
+type Message struct {
+	To        string
+	Subject   string
+	PlainBody string
+	HTMLBody  string
 }
 
-func New(s *SMTP) Mailer {
-	dialer := mail.NewDialer(s.Host, s.Port, s.Username, s.Password)
-	dialer.Timeout = 5 * time.Second
-
-	return Mailer{
-		dialer: dialer,
-		sender: s.Sender,
-	}
+type Mailer interface {
+	Send(msg *Message) error
 }
 
-func (m Mailer) Send(recipient, templateFile string, data interface{}) error {
-	tmpl, err := template.New("email").ParseFS(templateFS, "templates/"+templateFile)
-	if err != nil {
-		return err
-	}
-
-	subject := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(subject, "subject", data)
-	if err != nil {
-		return err
-	}
-
-	plainBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(plainBody, "plainBody", data)
-	if err != nil {
-		return err
-	}
-
-	htmlBody := new(bytes.Buffer)
-	err = tmpl.ExecuteTemplate(htmlBody, "htmlBody", data)
-	if err != nil {
-		return err
-	}
-
-	msg := mail.NewMessage()
-	msg.SetHeader("To", recipient)
-	msg.SetHeader("From", m.sender)
-	msg.SetHeader("Subject", subject.String())
-	msg.SetBody("text/plain", plainBody.String())
-	msg.AddAlternative("text/html", htmlBody.String())
-
-	for i := 1; i <= 3; i++ {
-		err = m.dialer.DialAndSend(msg)
-		if nil == err {
-			return nil
-		}
-
-		time.Sleep(500 * time.Millisecond)
+func New(cfg *Config) (Mailer, error) {
+	switch cfg.Transport {
+	case TransportSMTP:
+		return NewSMTPMailer(&cfg.SMTP, cfg.Sender), nil
+	case TransportConsole:
+		return NewConsoleMailer(os.Stdout, cfg.Sender), nil
+	case TransportMaildir:
+		return NewMaildirMailer(cfg.Maildir, cfg.Sender)
+	case TransportMemory:
+		return NewMemoryMailer(), nil
+	default:
+		return nil, fmt.Errorf("unknown mail transport %q", cfg.Transport)
 	}
-	return err
 }
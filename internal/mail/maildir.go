@@ -0,0 +1,65 @@
+package mail
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sync/atomic"
+	"time"
+)
+
+// MaildirMailer delivers messages as files into a maildir, which most mail
+// clients can open directly.
+type MaildirMailer struct {
+	dir      string
+	sender   string
+	hostname string
+	counter  atomic.Uint64
+}
+
+func NewMaildirMailer(dir, sender string) (*MaildirMailer, error) {
+	for _, sub := range []string{"tmp", "new", "cur"} {
+		err := os.MkdirAll(filepath.Join(dir, sub), 0o700)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	hostname, err := os.Hostname()
+	if err != nil {
+		hostname = "localhost"
+	}
+
+	return &MaildirMailer{
+		dir:      dir,
+		sender:   sender,
+		hostname: hostname,
+	}, nil
+}
+
+// Send writes the message to tmp first and then moves it to new, so readers
+// of the maildir never see a partially written message.
+func (m *MaildirMailer) Send(msg *Message) error {
+	name := fmt.Sprintf("%d.%d_%d.%s", time.Now().Unix(), os.Getpid(), m.counter.Add(1), m.hostname)
+	tmpPath := filepath.Join(m.dir, "tmp", name)
+
+	file, err := os.OpenFile(tmpPath, os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0o600)
+	if err != nil {
+		return err
+	}
+
+	_, err = newMIMEMessage(m.sender, msg).WriteTo(file)
+	if err != nil {
+		file.Close()
+		os.Remove(tmpPath)
+		return err
+	}
+
+	err = file.Close()
+	if err != nil {
+		os.Remove(tmpPath)
+		return err
+	}
+
+	return os.Rename(tmpPath, filepath.Join(m.dir, "new", name))
+}
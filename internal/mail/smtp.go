@@ -0,0 +1,43 @@
+package mail
+
+import (
+	"time"
+
+	"github.com/go-mail/mail/v2"
+)
+
+type SMTP struct {
+	Host     string
+	Port     int
+	Username string
+	Password string
+}
+
+type SMTPMailer struct {
+	dialer *mail.Dialer
+	sender string
+}
+
+func NewSMTPMailer(s *SMTP, sender string) *SMTPMailer {
+	dialer := mail.NewDialer(s.Host, s.Port, s.Username, s.Password)
+	dialer.Timeout = 5 * time.Second
+
+	return &SMTPMailer{
+		dialer: dialer,
+		sender: sender,
+	}
+}
+
+func (m *SMTPMailer) Send(msg *Message) error {
+	return m.dialer.DialAndSend(newMIMEMessage(m.sender, msg))
+}
+
+func newMIMEMessage(sender string, msg *Message) *mail.Message {
+	m := mail.NewMessage()
+	m.SetHeader("To", msg.To)
+	m.SetHeader("From", sender)
+	m.SetHeader("Subject", msg.Subject)
+	m.SetBody("text/plain", msg.PlainBody)
+	m.AddAlternative("text/html", msg.HTMLBody)
+	return m
+}
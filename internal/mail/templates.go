@@ -0,0 +1,183 @@
+package mail
+
+import (
+	"bytes"
+	"embed"
+	"fmt"
+	htmltemplate "html/template"
+	"io/fs"
+	"path"
+	"text/template"
+
+	"github.com/Li-Elias/Railclone/internal/i18n"
+)
+
+//go:embed "templates"
+var templateFS embed.FS
+
+// Data is the data rendered into a mail template. Every template has its own
+// data type, which also determines the template that is rendered.
+type Data interface {
+	Template() string
+}
+
+type ActivationData struct {
+	Token string
+}
+
+func (ActivationData) Template() string { return "user_activation.tmpl" }
+
+type AuthenticationData struct {
+	Token string
+}
+
+func (AuthenticationData) Template() string { return "user_authentication.tmpl" }
+
+type DeletionData struct {
+	Token string
+}
+
+func (DeletionData) Template() string { return "user_deletion.tmpl" }
+
+type EmailChangeData struct {
+	Token string
+}
+
+func (EmailChangeData) Template() string { return "user_email_change.tmpl" }
+
+type EmailChangeNoticeData struct {
+	NewEmail string
+}
+
+func (EmailChangeNoticeData) Template() string { return "user_email_change_notice.tmpl" }
+
+type RegistrationNoticeData struct{}
+
+func (RegistrationNoticeData) Template() string { return "user_registration_notice.tmpl" }
+
+// Previews returns sample data for every template. It is used to validate the
+// templates at startup and by cmd/mailpreview.
+func Previews() []Data {
+	const token = "Y3QMGX3PJ3WLRL2YRTQGQ6KRHU"
+
+	return []Data{
+		ActivationData{Token: token},
+		AuthenticationData{Token: token},
+		DeletionData{Token: token},
+		EmailChangeData{Token: token},
+		EmailChangeNoticeData{NewEmail: "new@example.com"},
+		RegistrationNoticeData{},
+	}
+}
+
+type Templates struct {
+	set map[string]map[string]*emailTemplate
+}
+
+// emailTemplate holds a template file parsed twice: the subject and the plain
+// body are rendered as text, so that they are not escaped as HTML, and only
+// the HTML body is rendered with html/template.
+type emailTemplate struct {
+	text *template.Template
+	html *htmltemplate.Template
+}
+
+// ParseTemplates parses the embedded templates of every locale once and
+// renders each of them with its preview data, so that a missing template,
+// block or field fails at startup instead of when an email is sent. Every
+// template must exist in the default locale, the other locales fall back to it
+// for templates they do not translate.
+func ParseTemplates() (*Templates, error) {
+	t := &Templates{set: make(map[string]map[string]*emailTemplate, len(i18n.Supported))}
+
+	for _, locale := range i18n.Supported {
+		files, err := fs.Glob(templateFS, path.Join("templates", locale, "*.tmpl"))
+		if err != nil {
+			return nil, err
+		}
+
+		t.set[locale] = make(map[string]*emailTemplate, len(files))
+
+		for _, file := range files {
+			text, err := template.New("email").Option("missingkey=error").ParseFS(templateFS, file)
+			if err != nil {
+				return nil, err
+			}
+
+			html, err := htmltemplate.New("email").Option("missingkey=error").ParseFS(templateFS, file)
+			if err != nil {
+				return nil, err
+			}
+
+			for _, name := range []string{"subject", "plainBody", "htmlBody"} {
+				if text.Lookup(name) == nil {
+					return nil, fmt.Errorf("mail template %s does not define %q", file, name)
+				}
+			}
+
+			t.set[locale][path.Base(file)] = &emailTemplate{text: text, html: html}
+		}
+	}
+
+	used := make(map[string]bool)
+
+	for _, data := range Previews() {
+		if _, ok := t.set[i18n.Default][data.Template()]; !ok {
+			return nil, fmt.Errorf("mail template %s does not exist for locale %s", data.Template(), i18n.Default)
+		}
+
+		for _, locale := range i18n.Supported {
+			_, err := t.Render("preview@example.com", locale, data)
+			if err != nil {
+				return nil, fmt.Errorf("mail template %s for locale %s: %w", data.Template(), locale, err)
+			}
+		}
+
+		used[data.Template()] = true
+	}
+
+	for locale, templates := range t.set {
+		for name := range templates {
+			if !used[name] {
+				return nil, fmt.Errorf("mail template %s for locale %s has no data type", name, locale)
+			}
+		}
+	}
+
+	return t, nil
+}
+
+func (t *Templates) Render(recipient, locale string, data Data) (*Message, error) {
+	tmpl, ok := t.set[locale][data.Template()]
+	if !ok {
+		tmpl, ok = t.set[i18n.Default][data.Template()]
+	}
+	if !ok {
+		return nil, fmt.Errorf("mail template %s does not exist", data.Template())
+	}
+
+	subject := new(bytes.Buffer)
+	err := tmpl.text.ExecuteTemplate(subject, "subject", data)
+	if err != nil {
+		return nil, err
+	}
+
+	plainBody := new(bytes.Buffer)
+	err = tmpl.text.ExecuteTemplate(plainBody, "plainBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	htmlBody := new(bytes.Buffer)
+	err = tmpl.html.ExecuteTemplate(htmlBody, "htmlBody", data)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Message{
+		To:        recipient,
+		Subject:   subject.String(),
+		PlainBody: plainBody.String(),
+		HTMLBody:  htmlBody.String(),
+	}, nil
+}
@@ -0,0 +1,39 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+type UsedChallengeModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Use records a challenge as used until its expiry, and reports whether it
+// had not been used before. Expired challenges are removed on the way.
+func (m UsedChallengeModel) Use(ctx context.Context, id []byte, expiry time.Time) (bool, error) {
+	query := `
+		WITH expired AS (
+			DELETE FROM used_challenges WHERE expiry < NOW()
+		)
+		INSERT INTO used_challenges (id, expiry)
+		VALUES ($1, $2)
+		ON CONFLICT DO NOTHING`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, expiry)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
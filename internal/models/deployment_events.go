@@ -0,0 +1,185 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"time"
+)
+
+// DeploymentEventsChannel is the channel Postgres notifies with the ID of
+// every new deployment event.
+const DeploymentEventsChannel = "deployment_events"
+
+// EventDeploymentCluster is the type of the events recorded for changes of
+// the Kubernetes objects of a deployment. The database itself records an
+// EventDeploymentCreated, EventDeploymentUpdated or EventDeploymentDeleted
+// event for every change of a deployment record.
+const EventDeploymentCluster = "deployment.cluster"
+
+type DeploymentEvent struct {
+	ID           int64           `json:"id"`
+	UserID       int64           `json:"-"`
+	DeploymentID int64           `json:"deployment_id"`
+	Type         string          `json:"type"`
+	Data         json.RawMessage `json:"data"`
+	CreatedAt    time.Time       `json:"created_at"`
+}
+
+type DeploymentEventModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// InsertOnce records an event unless one with the same source key has been
+// recorded already, and reports whether it did. Every API replica observes
+// the same cluster changes, and the key makes sure they are recorded once.
+func (m DeploymentEventModel) InsertOnce(ctx context.Context, event *DeploymentEvent, sourceKey string) (bool, error) {
+	query := `
+		INSERT INTO deployment_events (user_id, deployment_id, type, data, source_key)
+		VALUES ($1, $2, $3, $4, $5)
+		ON CONFLICT (source_key) DO NOTHING
+		RETURNING id, created_at`
+
+	args := []interface{}{event.UserID, event.DeploymentID, event.Type, string(event.Data), sourceKey}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&event.ID, &event.CreatedAt)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, nil
+		default:
+			return false, contextError(ctx, err)
+		}
+	}
+
+	return true, nil
+}
+
+func (m DeploymentEventModel) Get(ctx context.Context, id int64) (*DeploymentEvent, error) {
+	query := `
+		SELECT id, user_id, deployment_id, type, data, created_at
+		FROM deployment_events
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var event DeploymentEvent
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&event.ID,
+		&event.UserID,
+		&event.DeploymentID,
+		&event.Type,
+		&event.Data,
+		&event.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &event, nil
+}
+
+// LatestID returns the ID of the newest event, or 0 if there is none.
+func (m DeploymentEventModel) LatestID(ctx context.Context) (int64, error) {
+	query := `
+		SELECT COALESCE(MAX(id), 0)
+		FROM deployment_events`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var id int64
+
+	err := m.DB.QueryRowContext(ctx, query).Scan(&id)
+
+	return id, contextError(ctx, err)
+}
+
+// GetAllAfter returns up to limit events with an ID greater than afterID, in
+// order. A userID of 0 returns the events of every user.
+func (m DeploymentEventModel) GetAllAfter(ctx context.Context, userID int64, afterID int64, limit int) ([]*DeploymentEvent, error) {
+	query := `
+		SELECT id, user_id, deployment_id, type, data, created_at
+		FROM deployment_events
+		WHERE id > $1
+		AND (user_id = $2 OR $2 = 0)
+		ORDER BY id
+		LIMIT $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, afterID, userID, limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	events := []*DeploymentEvent{}
+
+	for rows.Next() {
+		var event DeploymentEvent
+		err := rows.Scan(
+			&event.ID,
+			&event.UserID,
+			&event.DeploymentID,
+			&event.Type,
+			&event.Data,
+			&event.CreatedAt,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		events = append(events, &event)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return events, nil
+}
+
+// CountAfter returns the number of events of the user with an ID greater than
+// afterID.
+func (m DeploymentEventModel) CountAfter(ctx context.Context, userID int64, afterID int64) (int, error) {
+	query := `
+		SELECT COUNT(*)
+		FROM deployment_events
+		WHERE id > $1
+		AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var count int
+
+	err := m.DB.QueryRowContext(ctx, query, afterID, userID).Scan(&count)
+
+	return count, contextError(ctx, err)
+}
+
+func (m DeploymentEventModel) DeleteOlderThan(ctx context.Context, before time.Time) error {
+	query := `
+		DELETE FROM deployment_events
+		WHERE created_at < $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, before)
+
+	return contextError(ctx, err)
+}
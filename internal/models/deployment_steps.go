@@ -0,0 +1,87 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	StepCompleted          = "completed"
+	StepFailed             = "failed"
+	StepCompensated        = "compensated"
+	StepCompensationFailed = "compensation_failed"
+)
+
+type DeploymentStep struct {
+	ID           int64     `json:"id"`
+	DeploymentID int64     `json:"deployment_id"`
+	Operation    string    `json:"operation"`
+	Step         string    `json:"step"`
+	State        string    `json:"state"`
+	Error        string    `json:"error,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+type DeploymentStepModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m DeploymentStepModel) Insert(ctx context.Context, step *DeploymentStep) error {
+	query := `
+		INSERT INTO deployment_steps (deployment_id, operation, step, state, error)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at`
+
+	args := []interface{}{step.DeploymentID, step.Operation, step.Step, step.State, step.Error}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&step.ID, &step.CreatedAt)
+
+	return contextError(ctx, err)
+}
+
+func (m DeploymentStepModel) GetAllForDeployment(ctx context.Context, deploymentID int64) ([]*DeploymentStep, error) {
+	query := `
+		SELECT id, deployment_id, operation, step, state, error, created_at
+		FROM deployment_steps
+		WHERE deployment_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, deploymentID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	steps := []*DeploymentStep{}
+
+	for rows.Next() {
+		var step DeploymentStep
+		err := rows.Scan(
+			&step.ID,
+			&step.DeploymentID,
+			&step.Operation,
+			&step.Step,
+			&step.State,
+			&step.Error,
+			&step.CreatedAt,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		steps = append(steps, &step)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return steps, nil
+}
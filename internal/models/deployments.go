@@ -5,6 +5,7 @@ import (
 	"database/sql"
 	"encoding/json"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Li-Elias/Railclone/internal/validator"
@@ -21,10 +22,21 @@ type Deployment struct {
 	LastUpdated time.Time         `json:"last_updated"`
 	UserID      int64             `json:"-"`
 	Running     bool              `json:"running"`
+	Status      string            `json:"status"`
+	Version     int32             `json:"version"`
 }
 
+const (
+	StatusProvisioning = "provisioning"
+	StatusReady        = "ready"
+	StatusUpdating     = "updating"
+	StatusDeleting     = "deleting"
+	StatusFailed       = "failed"
+)
+
 type DeploymentModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 type AvailableDeploymentData struct {
@@ -75,11 +87,11 @@ func ValidateDeployment(v *validator.Validator, deployment *Deployment) {
 	v.Check(validator.CheckEnvVars(deployment.EnvVars, AvailableDeployments[deployment.Image].EnvVars), "env_vars", "not available or valid")
 }
 
-func (m DeploymentModel) Insert(deployment *Deployment) error {
+func (m DeploymentModel) Insert(ctx context.Context, deployment *Deployment) error {
 	query := `
-		INSERT INTO deployments (image, port, volume, replicas, env_vars, user_id, running)
-		VALUES ($1, $2, $3, $4, $5, $6, $7)
-		RETURNING id, created_at, last_updated`
+		INSERT INTO deployments (image, port, volume, replicas, env_vars, user_id, running, status)
+		VALUES ($1, $2, $3, $4, $5, $6, $7, $8)
+		RETURNING id, created_at, last_updated, version`
 
 	envVars, err := json.Marshal(deployment.EnvVars)
 	if err != nil {
@@ -94,30 +106,147 @@ func (m DeploymentModel) Insert(deployment *Deployment) error {
 		envVars,
 		deployment.UserID,
 		deployment.Running,
+		deployment.Status,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	return m.DB.QueryRowContext(ctx, query, args...).Scan(
+	err = m.DB.QueryRowContext(ctx, query, args...).Scan(
 		&deployment.ID,
 		&deployment.CreatedAt,
 		&deployment.LastUpdated,
+		&deployment.Version,
 	)
+
+	return contextError(ctx, err)
+}
+
+type DeploymentFilter struct {
+	UserID  int64
+	Image   string
+	Status  string
+	Running *bool
+	Search  string
+}
+
+func (m DeploymentModel) GetAllFromUser(ctx context.Context, userID int64, filter DeploymentFilter, filters Filters) ([]*Deployment, Metadata, error) {
+	if userID < 1 {
+		return []*Deployment{}, Metadata{}, nil
+	}
+
+	filter.UserID = userID
+	return m.GetAll(ctx, filter, filters)
+}
+
+// deploymentFilterClause selects the deployments matching a DeploymentFilter.
+// The search matches the image, the status, the name of the Kubernetes objects
+// and the keys of the env vars.
+const deploymentFilterClause = `
+		WHERE (user_id = $1 OR $1 = 0)
+		AND (image = $2 OR $2 = '')
+		AND ($3::boolean IS NULL OR running = $3)
+		AND ($4 = ''
+			OR strpos(lower(image), lower($4)) > 0
+			OR strpos(lower(status), lower($4)) > 0
+			OR strpos('deployment-' || id || '-user-' || user_id, lower($4)) > 0
+			OR EXISTS (
+				SELECT 1
+				FROM jsonb_object_keys(CASE WHEN jsonb_typeof(env_vars::jsonb) = 'object' THEN env_vars::jsonb ELSE '{}' END) AS key
+				WHERE strpos(lower(key), lower($4)) > 0
+			))
+		AND (status = $5 OR $5 = '')`
+
+// GetAll returns the deployments of every user unless the filter restricts
+// them to one.
+func (m DeploymentModel) GetAll(ctx context.Context, filter DeploymentFilter, filters Filters) ([]*Deployment, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, image, port, volume, replicas, env_vars, created_at, last_updated, user_id, running, status, version
+		FROM deployments
+		%s
+		ORDER BY %s %s, id ASC
+		LIMIT $6 OFFSET $7`, deploymentFilterClause, filters.sortColumn(), filters.sortDirection())
+
+	running := sql.NullBool{}
+	if filter.Running != nil {
+		running = sql.NullBool{Bool: *filter.Running, Valid: true}
+	}
+
+	args := []interface{}{filter.UserID, filter.Image, running, filter.Search, filter.Status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deployments := []*Deployment{}
+
+	for rows.Next() {
+		var envVars []byte
+		var deployment Deployment
+		err := rows.Scan(
+			&totalRecords,
+			&deployment.ID,
+			&deployment.Image,
+			&deployment.Port,
+			&deployment.Volume,
+			&deployment.Replicas,
+			&envVars,
+			&deployment.CreatedAt,
+			&deployment.LastUpdated,
+			&deployment.UserID,
+			&deployment.Running,
+			&deployment.Status,
+			&deployment.Version,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		err = json.Unmarshal(envVars, &deployment.EnvVars)
+		if err != nil {
+			return nil, Metadata{}, err
+		}
+
+		deployments = append(deployments, &deployment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	// a page past the last one has no rows to take the count from
+	if len(deployments) == 0 && filters.Page > 1 {
+		query = `SELECT count(*) FROM deployments` + deploymentFilterClause
+
+		err = m.DB.QueryRowContext(ctx, query, args[:5]...).Scan(&totalRecords)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deployments, metadata, nil
 }
 
-func (m DeploymentModel) GetAllFromUser(userID int64) ([]*Deployment, error) {
+func (m DeploymentModel) GetAllByStatus(ctx context.Context, status string) ([]*Deployment, error) {
 	query := `
-		SELECT *
+		SELECT id, image, port, volume, replicas, env_vars, created_at, last_updated, user_id, running, status, version
 		FROM deployments
-		WHERE user_id = $1`
+		WHERE status = $1
+		ORDER BY last_updated`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	rows, err := m.DB.QueryContext(ctx, query, userID)
+	rows, err := m.DB.QueryContext(ctx, query, status)
 	if err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 	defer rows.Close()
 
@@ -137,11 +266,66 @@ func (m DeploymentModel) GetAllFromUser(userID int64) ([]*Deployment, error) {
 			&deployment.LastUpdated,
 			&deployment.UserID,
 			&deployment.Running,
+			&deployment.Status,
+			&deployment.Version,
 		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		err = json.Unmarshal(envVars, &deployment.EnvVars)
 		if err != nil {
 			return nil, err
 		}
 
+		deployments = append(deployments, &deployment)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return deployments, nil
+}
+
+func (m DeploymentModel) GetAllForUser(ctx context.Context, userID int64) ([]*Deployment, error) {
+	query := `
+		SELECT id, image, port, volume, replicas, env_vars, created_at, last_updated, user_id, running, status, version
+		FROM deployments
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	deployments := []*Deployment{}
+
+	for rows.Next() {
+		var envVars []byte
+		var deployment Deployment
+		err := rows.Scan(
+			&deployment.ID,
+			&deployment.Image,
+			&deployment.Port,
+			&deployment.Volume,
+			&deployment.Replicas,
+			&envVars,
+			&deployment.CreatedAt,
+			&deployment.LastUpdated,
+			&deployment.UserID,
+			&deployment.Running,
+			&deployment.Status,
+			&deployment.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
 		err = json.Unmarshal(envVars, &deployment.EnvVars)
 		if err != nil {
 			return nil, err
@@ -150,25 +334,74 @@ func (m DeploymentModel) GetAllFromUser(userID int64) ([]*Deployment, error) {
 		deployments = append(deployments, &deployment)
 	}
 	if err = rows.Err(); err != nil {
-		return nil, err
+		return nil, contextError(ctx, err)
 	}
 
 	return deployments, nil
 }
 
-func (m DeploymentModel) GetFromUser(id int64, userID int64) (*Deployment, error) {
+func (m DeploymentModel) Get(ctx context.Context, id int64) (*Deployment, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, image, port, volume, replicas, env_vars, created_at, last_updated, user_id, running, status, version
+		FROM deployments
+		WHERE id = $1`
+
+	args := []interface{}{id}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var envVars []byte
+	var deployment Deployment
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
+		&deployment.ID,
+		&deployment.Image,
+		&deployment.Port,
+		&deployment.Volume,
+		&deployment.Replicas,
+		&envVars,
+		&deployment.CreatedAt,
+		&deployment.LastUpdated,
+		&deployment.UserID,
+		&deployment.Running,
+		&deployment.Status,
+		&deployment.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	err = json.Unmarshal(envVars, &deployment.EnvVars)
+	if err != nil {
+		return nil, err
+	}
+
+	return &deployment, nil
+}
+
+func (m DeploymentModel) GetFromUser(ctx context.Context, id int64, userID int64) (*Deployment, error) {
 	if id < 1 {
 		return nil, ErrRecordNotFound
 	}
 
 	query := `
-		SELECT *
+		SELECT id, image, port, volume, replicas, env_vars, created_at, last_updated, user_id, running, status, version
 		FROM deployments
 		WHERE id = $1 AND user_id = $2`
 
 	args := []interface{}{id, userID}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	var envVars []byte
@@ -185,13 +418,15 @@ func (m DeploymentModel) GetFromUser(id int64, userID int64) (*Deployment, error
 		&deployment.LastUpdated,
 		&deployment.UserID,
 		&deployment.Running,
+		&deployment.Status,
+		&deployment.Version,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
@@ -203,19 +438,20 @@ func (m DeploymentModel) GetFromUser(id int64, userID int64) (*Deployment, error
 	return &deployment, nil
 }
 
-func (m DeploymentModel) UpdateFromUser(id int64, userID int64, deployment *Deployment) (*Deployment, error) {
+func (m DeploymentModel) UpdateFromUser(ctx context.Context, id int64, userID int64, deployment *Deployment) (*Deployment, error) {
 	query := `
 		UPDATE deployments
-		SET last_updated = $1, port = $4, volume = $5, replicas = $6, env_vars = $7, running = $8
-		WHERE id = $2 AND user_id = $3
-		RETURNING id, image, port, volume, replicas, created_at, last_updated, user_id, running`
+		SET last_updated = $1, port = $4, volume = $5, replicas = $6, env_vars = $7, running = $8, status = $9,
+			version = version + 1
+		WHERE id = $2 AND user_id = $3 AND version = $10 AND status <> 'deleting'
+		RETURNING id, image, port, volume, replicas, created_at, last_updated, user_id, running, status, version`
 
 	envVars, err := json.Marshal(deployment.EnvVars)
 	if err != nil {
 		return nil, err
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	args := []interface{}{
@@ -227,6 +463,8 @@ func (m DeploymentModel) UpdateFromUser(id int64, userID int64, deployment *Depl
 		deployment.Replicas,
 		envVars,
 		deployment.Running,
+		deployment.Status,
+		deployment.Version,
 	}
 
 	var updatedDeployment Deployment
@@ -241,13 +479,15 @@ func (m DeploymentModel) UpdateFromUser(id int64, userID int64, deployment *Depl
 		&updatedDeployment.LastUpdated,
 		&updatedDeployment.UserID,
 		&updatedDeployment.Running,
+		&updatedDeployment.Status,
+		&updatedDeployment.Version,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
-			return nil, ErrRecordNotFound
+			return nil, ErrEditConflict
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
@@ -256,7 +496,7 @@ func (m DeploymentModel) UpdateFromUser(id int64, userID int64, deployment *Depl
 	return &updatedDeployment, nil
 }
 
-func (m DeploymentModel) DeleteFromUser(id int64, userID int64) error {
+func (m DeploymentModel) DeleteFromUser(ctx context.Context, id int64, userID int64) error {
 	if id < 1 {
 		return ErrRecordNotFound
 	}
@@ -265,14 +505,40 @@ func (m DeploymentModel) DeleteFromUser(id int64, userID int64) error {
 		DELETE FROM deployments
 		WHERE id = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
 	}
 
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+func (m DeploymentModel) UpdateStatus(ctx context.Context, id int64, status string) error {
+	query := `
+		UPDATE deployments
+		SET status = $1, last_updated = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, status, time.Now(), id)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
 	rowsAffected, err := result.RowsAffected()
 	if err != nil {
 		return err
@@ -284,3 +550,28 @@ func (m DeploymentModel) DeleteFromUser(id int64, userID int64) error {
 
 	return nil
 }
+
+// SwapStatus changes the status of a deployment only if it still has the
+// status old, and reports whether it did, so that only one of several API
+// replicas acts on a change observed by all of them.
+func (m DeploymentModel) SwapStatus(ctx context.Context, id int64, old, status string) (bool, error) {
+	query := `
+		UPDATE deployments
+		SET status = $1, last_updated = $2
+		WHERE id = $3 AND status = $4`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, status, time.Now(), id, old)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return false, err
+	}
+
+	return rowsAffected == 1, nil
+}
@@ -1,25 +1,65 @@
 package models
 
 import (
+	"context"
 	"database/sql"
 	"errors"
+	"time"
 )
 
 var (
 	ErrRecordNotFound = errors.New("record not found")
 	ErrEditConflict   = errors.New("edit conflict")
+	ErrCanceled       = errors.New("query canceled")
+	ErrTimeout        = errors.New("query timed out")
 )
 
 type Models struct {
-	Users       UserModel
-	Deployments DeploymentModel
-	Tokens      TokenModel
+	Users           UserModel
+	Deployments     DeploymentModel
+	DeploymentSteps DeploymentStepModel
+	Tokens          TokenModel
+	Outbox          OutboxModel
+	OIDCLogins      OIDCLoginModel
+	TOTP            TOTPModel
+	Quotas          QuotaModel
+
+	Webhooks          WebhookModel
+	WebhookDeliveries WebhookDeliveryModel
+	DeploymentEvents  DeploymentEventModel
+	UsedChallenges    UsedChallengeModel
 }
 
-func NewModels(db *sql.DB) Models {
+func NewModels(db *sql.DB, timeout time.Duration) Models {
 	return Models{
-		Users:       UserModel{DB: db},
-		Deployments: DeploymentModel{DB: db},
-		Tokens:      TokenModel{DB: db},
+		Users:           UserModel{DB: db, Timeout: timeout},
+		Deployments:     DeploymentModel{DB: db, Timeout: timeout},
+		DeploymentSteps: DeploymentStepModel{DB: db, Timeout: timeout},
+		Tokens:          TokenModel{DB: db, Timeout: timeout},
+		Outbox:          OutboxModel{DB: db, Timeout: timeout},
+		OIDCLogins:      OIDCLoginModel{DB: db, Timeout: timeout},
+		TOTP:            TOTPModel{DB: db, Timeout: timeout},
+		Quotas:          QuotaModel{DB: db, Timeout: timeout},
+
+		Webhooks:          WebhookModel{DB: db, Timeout: timeout},
+		WebhookDeliveries: WebhookDeliveryModel{DB: db, Timeout: timeout},
+		DeploymentEvents:  DeploymentEventModel{DB: db, Timeout: timeout},
+		UsedChallenges:    UsedChallengeModel{DB: db, Timeout: timeout},
+	}
+}
+
+// contextError maps a failed query to ErrCanceled or ErrTimeout when the
+// context is the reason it failed, so callers can tell them apart from
+// database errors.
+func contextError(ctx context.Context, err error) error {
+	switch {
+	case err == nil:
+		return nil
+	case errors.Is(err, context.Canceled), errors.Is(ctx.Err(), context.Canceled):
+		return ErrCanceled
+	case errors.Is(err, context.DeadlineExceeded), errors.Is(ctx.Err(), context.DeadlineExceeded):
+		return ErrTimeout
+	default:
+		return err
 	}
 }
@@ -0,0 +1,74 @@
+package models
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"errors"
+	"time"
+)
+
+type OIDCLogin struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+	Expiry       time.Time
+}
+
+type OIDCLoginModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Insert stores a pending login under the hash of its state and removes the
+// logins that were never completed.
+func (m OIDCLoginModel) Insert(ctx context.Context, login *OIDCLogin) error {
+	stateHash := sha256.Sum256([]byte(login.State))
+
+	query := `
+		WITH expired AS (
+			DELETE FROM oidc_logins WHERE expiry < NOW()
+		)
+		INSERT INTO oidc_logins (state_hash, nonce, code_verifier, expiry)
+		VALUES ($1, $2, $3, $4)`
+
+	args := []interface{}{stateHash[:], login.Nonce, login.CodeVerifier, login.Expiry}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, args...)
+	return contextError(ctx, err)
+}
+
+// Consume removes the login with the given state and returns it, so that a
+// state can only be redeemed once.
+func (m OIDCLoginModel) Consume(ctx context.Context, state string) (*OIDCLogin, error) {
+	stateHash := sha256.Sum256([]byte(state))
+
+	query := `
+		DELETE FROM oidc_logins
+		WHERE state_hash = $1
+		RETURNING nonce, code_verifier, expiry`
+
+	login := OIDCLogin{State: state}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, stateHash[:]).Scan(&login.Nonce, &login.CodeVerifier, &login.Expiry)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	if time.Now().After(login.Expiry) {
+		return nil, ErrRecordNotFound
+	}
+
+	return &login, nil
+}
@@ -0,0 +1,245 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+const (
+	EmailPending = "pending"
+	EmailSent    = "sent"
+	EmailDead    = "dead"
+)
+
+type Email struct {
+	ID            int64      `json:"id"`
+	Recipient     string     `json:"recipient"`
+	Subject       string     `json:"subject"`
+	PlainBody     string     `json:"-"`
+	HTMLBody      string     `json:"-"`
+	Status        string     `json:"status"`
+	Attempts      int        `json:"attempts"`
+	NextAttemptAt time.Time  `json:"next_attempt_at"`
+	LastError     string     `json:"last_error,omitempty"`
+	CreatedAt     time.Time  `json:"created_at"`
+	SentAt        *time.Time `json:"sent_at,omitempty"`
+}
+
+type OutboxModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+type querier interface {
+	ExecContext(ctx context.Context, query string, args ...interface{}) (sql.Result, error)
+	QueryRowContext(ctx context.Context, query string, args ...interface{}) *sql.Row
+}
+
+func insertEmail(ctx context.Context, q querier, email *Email) error {
+	query := `
+		INSERT INTO email_outbox (recipient, subject, plain_body, html_body)
+		VALUES ($1, $2, $3, $4)
+		RETURNING id, status, next_attempt_at, created_at`
+
+	args := []interface{}{email.Recipient, email.Subject, email.PlainBody, email.HTMLBody}
+
+	return q.QueryRowContext(ctx, query, args...).Scan(
+		&email.ID,
+		&email.Status,
+		&email.NextAttemptAt,
+		&email.CreatedAt,
+	)
+}
+
+func (m OutboxModel) Insert(ctx context.Context, email *Email) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	return contextError(ctx, insertEmail(ctx, m.DB, email))
+}
+
+// Claim picks up to limit emails that are due for delivery and pushes their
+// next attempt back by lease, so that other workers skip them while they are
+// being delivered and they are retried if the worker dies.
+func (m OutboxModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*Email, error) {
+	query := `
+		UPDATE email_outbox
+		SET attempts = attempts + 1, next_attempt_at = $1
+		WHERE id IN (
+			SELECT id
+			FROM email_outbox
+			WHERE status = 'pending' AND next_attempt_at <= NOW()
+			ORDER BY next_attempt_at
+			LIMIT $2
+			FOR UPDATE SKIP LOCKED
+		)
+		RETURNING id, recipient, subject, plain_body, html_body, status, attempts, next_attempt_at, last_error, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now().Add(lease), limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+		err := rows.Scan(
+			&email.ID,
+			&email.Recipient,
+			&email.Subject,
+			&email.PlainBody,
+			&email.HTMLBody,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.CreatedAt,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		emails = append(emails, &email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return emails, nil
+}
+
+// MarkSent also clears the bodies, which contain plaintext tokens that must
+// not outlive the delivery.
+func (m OutboxModel) MarkSent(ctx context.Context, id int64) error {
+	query := `
+		UPDATE email_outbox
+		SET status = 'sent', sent_at = NOW(), last_error = '', plain_body = '', html_body = ''
+		WHERE id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, id)
+
+	return contextError(ctx, err)
+}
+
+func (m OutboxModel) MarkFailed(ctx context.Context, id int64, lastError string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE email_outbox
+		SET last_error = $1, next_attempt_at = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastError, nextAttemptAt, id)
+
+	return contextError(ctx, err)
+}
+
+func (m OutboxModel) MarkDead(ctx context.Context, id int64, lastError string) error {
+	query := `
+		UPDATE email_outbox
+		SET status = 'dead', last_error = $1, plain_body = '', html_body = ''
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, lastError, id)
+
+	return contextError(ctx, err)
+}
+
+func (m OutboxModel) CountByStatus(ctx context.Context) (map[string]int, error) {
+	query := `
+		SELECT status, count(*)
+		FROM email_outbox
+		GROUP BY status`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	counts := map[string]int{EmailPending: 0, EmailSent: 0, EmailDead: 0}
+
+	for rows.Next() {
+		var status string
+		var count int
+		err := rows.Scan(&status, &count)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		counts[status] = count
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return counts, nil
+}
+
+func (m OutboxModel) GetAll(ctx context.Context, status string, recipient string, filters Filters) ([]*Email, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, recipient, subject, status, attempts, next_attempt_at, last_error, created_at, sent_at
+		FROM email_outbox
+		WHERE (status = $1 OR $1 = '')
+		AND (recipient = $2 OR $2 = '')
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`
+
+	args := []interface{}{status, recipient, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	emails := []*Email{}
+
+	for rows.Next() {
+		var email Email
+		err := rows.Scan(
+			&totalRecords,
+			&email.ID,
+			&email.Recipient,
+			&email.Subject,
+			&email.Status,
+			&email.Attempts,
+			&email.NextAttemptAt,
+			&email.LastError,
+			&email.CreatedAt,
+			&email.SentAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		emails = append(emails, &email)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return emails, metadata, nil
+}
@@ -0,0 +1,54 @@
+package models
+
+import (
+	"context"
+	"database/sql"
+	"time"
+)
+
+// quotaRetention is how long token requests are kept at least. They are kept
+// for the quota window if that is longer.
+const quotaRetention = 24 * time.Hour
+
+type Quota struct {
+	EmailLimit int
+	IPLimit    int
+	Window     time.Duration
+}
+
+type QuotaModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// AllowTokenRequest records a request for an emailed token and reports
+// whether the email address and the IP are still within their quotas. Every
+// request is recorded, whether the address belongs to a user or not, so that
+// the quotas do not reveal which addresses are registered.
+func (m QuotaModel) AllowTokenRequest(ctx context.Context, email, ip string, quota Quota) (bool, error) {
+	query := `
+		WITH expired AS (
+			DELETE FROM token_requests WHERE created_at < $4
+		), inserted AS (
+			INSERT INTO token_requests (email, ip) VALUES ($1, $2)
+		)
+		SELECT
+			(SELECT count(*) FROM token_requests WHERE email = $1 AND created_at > $3),
+			(SELECT count(*) FROM token_requests WHERE ip = $2 AND created_at > $3)`
+
+	now := time.Now()
+	args := []interface{}{email, ip, now.Add(-quota.Window), now.Add(-max(quota.Window, quotaRetention))}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var emailCount, ipCount int
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&emailCount, &ipCount)
+	if err != nil {
+		return false, contextError(ctx, err)
+	}
+
+	// the counts do not include the request that was just inserted
+	return emailCount < quota.EmailLimit && ipCount < quota.IPLimit, nil
+}
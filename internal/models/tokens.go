@@ -15,18 +15,35 @@ const (
 	ScopeActivation     = "activation"
 	ScopeAuthentication = "authentication"
 	ScopeDeletion       = "deletion"
+	ScopeTwoFactor      = "two-factor"
+	ScopeEmailChange    = "email-change"
 )
 
+// maxOutstandingTokens is the number of unexpired tokens a user can have per
+// scope. Issuing another one revokes the oldest. Authentication tokens are
+// also the sessions of the user, so they get more room. Tokens sent by email
+// are pending until they are first used and are counted apart from the
+// others, so that requesting them never revokes a session in use.
+var maxOutstandingTokens = map[string]int{
+	ScopeActivation:     3,
+	ScopeAuthentication: 10,
+	ScopeDeletion:       3,
+	ScopeTwoFactor:      3,
+	ScopeEmailChange:    1,
+}
+
 type Token struct {
 	Plaintext string    `json:"token"`
 	Hash      []byte    `json:"-"`
 	UserID    int64     `json:"-"`
 	Expiry    time.Time `json:"expiry"`
 	Scope     string    `json:"-"`
+	NewEmail  string    `json:"-"`
 }
 
 type TokenModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 func generateToken(userID int64, ttl time.Duration, scope string) (*Token, error) {
@@ -56,41 +73,178 @@ func ValidateTokenPlaintext(v *validator.Validator, tokenPlaintext string) {
 	v.Check(len(tokenPlaintext) == 26, "token", "must be 26 bytes long")
 }
 
-func (m TokenModel) New(userID int64, ttl time.Duration, scope string) (*Token, error) {
+func (m TokenModel) New(ctx context.Context, userID int64, ttl time.Duration, scope string) (*Token, error) {
 	token, err := generateToken(userID, ttl, scope)
 	if err != nil {
 		return nil, err
 	}
 
-	err = m.Insert(token)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err = revokeExcessTokens(ctx, m.DB, userID, scope, false)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = m.Insert(ctx, token)
 
 	return token, err
 }
 
-func (m TokenModel) Insert(token *Token) error {
+// revokeExcessTokens deletes the expired tokens of the user in the scope and
+// the oldest unexpired ones that are pending or not, leaving room for one
+// more.
+func revokeExcessTokens(ctx context.Context, q querier, userID int64, scope string, pending bool) error {
+	query := `
+		DELETE FROM tokens
+		WHERE user_id = $1 AND scope = $2
+		AND (expiry <= NOW() OR hash IN (
+			SELECT hash
+			FROM tokens
+			WHERE user_id = $1 AND scope = $2 AND pending = $4 AND expiry > NOW()
+			ORDER BY expiry DESC
+			OFFSET $3
+		))`
+
+	_, err := q.ExecContext(ctx, query, userID, scope, maxOutstandingTokens[scope]-1, pending)
+	return err
+}
+
+// NewWithEmail creates a token and queues the email that delivers it in one
+// transaction, so a token is never issued without its email being queued.
+func (m TokenModel) NewWithEmail(ctx context.Context, userID int64, ttl time.Duration, scope string, email func(token *Token) (*Email, error)) (*Token, error) {
+	token, err := generateToken(userID, ttl, scope)
+	if err != nil {
+		return nil, err
+	}
+
+	msg, err := email(token)
+	if err != nil {
+		return nil, err
+	}
+
+	query := `
+		INSERT INTO tokens (hash, user_id, expiry, scope, pending)
+		VALUES ($1, $2, $3, $4, true)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	err = revokeExcessTokens(ctx, tx, userID, scope, true)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = insertEmail(ctx, tx, msg)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return token, nil
+}
+
+// NewEmailChange creates an email change token that carries the new email
+// address and queues its emails in one transaction. Any earlier email change
+// tokens of the user are revoked, so only the latest request can be redeemed.
+func (m TokenModel) NewEmailChange(ctx context.Context, userID int64, ttl time.Duration, newEmail string, emails func(token *Token) ([]*Email, error)) (*Token, error) {
+	token, err := generateToken(userID, ttl, ScopeEmailChange)
+	if err != nil {
+		return nil, err
+	}
+	token.NewEmail = newEmail
+
+	msgs, err := emails(token)
+	if err != nil {
+		return nil, err
+	}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		DELETE FROM tokens
+		WHERE scope = $1 AND user_id = $2`
+
+	_, err = tx.ExecContext(ctx, query, ScopeEmailChange, userID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	query = `
+		INSERT INTO tokens (hash, user_id, expiry, scope, new_email)
+		VALUES ($1, $2, $3, $4, $5)`
+
+	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope, token.NewEmail}
+
+	_, err = tx.ExecContext(ctx, query, args...)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	for _, msg := range msgs {
+		err = insertEmail(ctx, tx, msg)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return token, nil
+}
+
+func (m TokenModel) Insert(ctx context.Context, token *Token) error {
 	query := `
 		INSERT INTO tokens (hash, user_id, expiry, scope)
 		VALUES ($1, $2, $3, $4)`
 
 	args := []interface{}{token.Hash, token.UserID, token.Expiry, token.Scope}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, args...)
 
-	return err
+	return contextError(ctx, err)
 }
 
-func (m TokenModel) DeleteAllForUser(scope string, userID int64) error {
+func (m TokenModel) DeleteAllForUser(ctx context.Context, scope string, userID int64) error {
 	query := `
 		DELETE FROM tokens
 		WHERE scope = $1 AND user_id = $2`
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	_, err := m.DB.ExecContext(ctx, query, scope, userID)
 
-	return err
+	return contextError(ctx, err)
 }
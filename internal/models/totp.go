@@ -0,0 +1,273 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base32"
+	"errors"
+	"strings"
+	"time"
+)
+
+const recoveryCodeCount = 10
+
+var ErrTOTPReplay = errors.New("totp code has already been used")
+
+type TOTP struct {
+	UserID   int64
+	Secret   string
+	Enabled  bool
+	LastStep int64
+}
+
+type TOTPModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// GenerateRecoveryCodes returns recovery codes in the form XXXXX-XXXXX.
+func GenerateRecoveryCodes() ([]string, error) {
+	codes := make([]string, recoveryCodeCount)
+
+	for i := range codes {
+		randomBytes := make([]byte, 7)
+
+		_, err := rand.Read(randomBytes)
+		if err != nil {
+			return nil, err
+		}
+
+		code := base32.StdEncoding.WithPadding(base32.NoPadding).EncodeToString(randomBytes)[:10]
+		codes[i] = code[:5] + "-" + code[5:]
+	}
+
+	return codes, nil
+}
+
+func hashRecoveryCode(code string) []byte {
+	normalized := strings.ToUpper(strings.ReplaceAll(strings.TrimSpace(code), "-", ""))
+	hash := sha256.Sum256([]byte(normalized))
+	return hash[:]
+}
+
+func (m TOTPModel) Get(ctx context.Context, userID int64) (*TOTP, error) {
+	query := `
+		SELECT user_id, secret, enabled, last_step
+		FROM user_totp
+		WHERE user_id = $1`
+
+	var t TOTP
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID).Scan(&t.UserID, &t.Secret, &t.Enabled, &t.LastStep)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &t, nil
+}
+
+// Enrol stores a new secret that is not enabled until it has been confirmed
+// with a code. An enabled secret is never replaced.
+func (m TOTPModel) Enrol(ctx context.Context, userID int64, secret string) error {
+	query := `
+		INSERT INTO user_totp (user_id, secret)
+		VALUES ($1, $2)
+		ON CONFLICT (user_id) DO UPDATE SET secret = $2, last_step = 0, created_at = NOW()
+		WHERE user_totp.enabled = false`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, secret)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	return nil
+}
+
+// Enable enables the secret of the user, records the step of the code that
+// confirmed it and replaces the recovery codes.
+func (m TOTPModel) Enable(ctx context.Context, userID, step int64, recoveryCodes []string) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE user_totp
+		SET enabled = true, last_step = $2
+		WHERE user_id = $1 AND enabled = false AND last_step < $2`
+
+	result, err := tx.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrEditConflict
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	for _, code := range recoveryCodes {
+		_, err = tx.ExecContext(ctx, `INSERT INTO totp_recovery_codes (hash, user_id) VALUES ($1, $2)`, hashRecoveryCode(code), userID)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.Commit()
+	return contextError(ctx, err)
+}
+
+func (m TOTPModel) Disable(ctx context.Context, userID int64) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM totp_recovery_codes WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM user_totp WHERE user_id = $1`, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	err = tx.Commit()
+	return contextError(ctx, err)
+}
+
+// UseStep records the step of a verified code. It fails with ErrTOTPReplay
+// when the step is not newer than the last one used, so that a code can only
+// be used once.
+func (m TOTPModel) UseStep(ctx context.Context, userID, step int64) error {
+	query := `
+		UPDATE user_totp
+		SET last_step = $2
+		WHERE user_id = $1 AND last_step < $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, userID, step)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrTOTPReplay
+	}
+
+	return nil
+}
+
+// UseRecoveryCode redeems a recovery code of the user.
+func (m TOTPModel) UseRecoveryCode(ctx context.Context, userID int64, code string) error {
+	query := `
+		DELETE FROM totp_recovery_codes
+		WHERE hash = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, hashRecoveryCode(code), userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+// FailAttempt records a wrong code for the user. It returns true, and starts
+// counting again, when that makes limit wrong codes in a row.
+func (m TOTPModel) FailAttempt(ctx context.Context, userID int64, limit int) (bool, error) {
+	query := `
+		UPDATE user_totp
+		SET failed_attempts = CASE WHEN failed_attempts + 1 >= $2 THEN 0 ELSE failed_attempts + 1 END
+		WHERE user_id = $1
+		RETURNING failed_attempts = 0`
+
+	var exceeded bool
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, userID, limit).Scan(&exceeded)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return false, ErrRecordNotFound
+		default:
+			return false, contextError(ctx, err)
+		}
+	}
+
+	return exceeded, nil
+}
+
+// ResetFailedAttempts clears the wrong codes of the user after a right one.
+func (m TOTPModel) ResetFailedAttempts(ctx context.Context, userID int64) error {
+	query := `
+		UPDATE user_totp
+		SET failed_attempts = 0
+		WHERE user_id = $1`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, userID)
+	return contextError(ctx, err)
+}
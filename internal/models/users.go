@@ -5,11 +5,17 @@ import (
 	"crypto/sha256"
 	"database/sql"
 	"errors"
+	"fmt"
 	"time"
 
 	"github.com/Li-Elias/Railclone/internal/validator"
 )
 
+const (
+	RoleUser  = "user"
+	RoleAdmin = "admin"
+)
+
 var (
 	ErrDuplicateEmail = errors.New("duplicate email")
 	AnonymousUser     = &User{}
@@ -21,10 +27,14 @@ type User struct {
 	CreatedAt   time.Time `json:"created_at"`
 	LastUpdated time.Time `json:"last_updated"`
 	Activated   bool      `json:"activated"`
+	Locale      string    `json:"locale"`
+	Role        string    `json:"role"`
+	Suspended   bool      `json:"suspended"`
 }
 
 type UserModel struct {
-	DB *sql.DB
+	DB      *sql.DB
+	Timeout time.Duration
 }
 
 func ValidateEmail(v *validator.Validator, email string) {
@@ -36,38 +46,42 @@ func (user *User) IsAnonymous() bool {
 	return user == AnonymousUser
 }
 
-func (m UserModel) Insert(user *User) error {
+func (user *User) IsAdmin() bool {
+	return user.Role == RoleAdmin
+}
+
+func (m UserModel) Insert(ctx context.Context, user *User) error {
 	query := `
-		INSERT INTO users (email, activated)
-		VALUES ($1, $2)
-		RETURNING id, created_at, last_updated`
+		INSERT INTO users (email, activated, locale)
+		VALUES ($1, $2, $3)
+		RETURNING id, created_at, last_updated, role, suspended`
 
-	args := []interface{}{user.Email, user.Activated}
+	args := []interface{}{user.Email, user.Activated, user.Locale}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
-	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.LastUpdated)
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.ID, &user.CreatedAt, &user.LastUpdated, &user.Role, &user.Suspended)
 	if err != nil {
 		switch {
 		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
 			return ErrDuplicateEmail
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 	return nil
 }
 
-func (m UserModel) GetByEmail(email string) (*User, error) {
+func (m UserModel) GetByEmail(ctx context.Context, email string) (*User, error) {
 	query := `
-		SELECT id, email, created_at, last_updated, activated
+		SELECT id, email, created_at, last_updated, activated, locale, role, suspended
 		FROM users
 		WHERE email = $1`
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, email).Scan(
@@ -76,6 +90,9 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		&user.CreatedAt,
 		&user.LastUpdated,
 		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
 	)
 
 	if err != nil {
@@ -83,17 +100,22 @@ func (m UserModel) GetByEmail(email string) (*User, error) {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 	return &user, nil
 }
 
-func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error) {
+func (m UserModel) GetForToken(ctx context.Context, tokenScope, tokenPlaintext string) (*User, error) {
 	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
 
+	// the first use of a token sent by email makes it count as one in use
 	query := `
-		SELECT users.id, users.email, users.created_at, users.last_updated, users.activated 
+		WITH used AS (
+			UPDATE tokens SET pending = false
+			WHERE hash = $1 AND scope = $2 AND expiry > $3 AND pending
+		)
+		SELECT users.id, users.email, users.created_at, users.last_updated, users.activated, users.locale, users.role, users.suspended
 		FROM users
 		INNER JOIN tokens ON users.id = tokens.user_id
 		WHERE tokens.hash = $1
@@ -104,7 +126,7 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 
 	var user User
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(
@@ -113,34 +135,38 @@ func (m UserModel) GetForToken(tokenScope, tokenPlaintext string) (*User, error)
 		&user.CreatedAt,
 		&user.LastUpdated,
 		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
 	)
 	if err != nil {
 		switch {
 		case errors.Is(err, sql.ErrNoRows):
 			return nil, ErrRecordNotFound
 		default:
-			return nil, err
+			return nil, contextError(ctx, err)
 		}
 	}
 
 	return &user, nil
 }
 
-func (m UserModel) Update(user *User) error {
+func (m UserModel) Update(ctx context.Context, user *User) error {
 	query := `
 		UPDATE users
-		SET email = $1, activated = $2, last_updated = $3
-		WHERE id = $4
+		SET email = $1, activated = $2, locale = $3, last_updated = $4
+		WHERE id = $5
 		RETURNING last_updated`
 
 	args := []interface{}{
 		user.Email,
 		user.Activated,
+		user.Locale,
 		time.Now(),
 		user.ID,
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 3*time.Second)
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
 	defer cancel()
 
 	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&user.LastUpdated)
@@ -151,8 +177,323 @@ func (m UserModel) Update(user *User) error {
 		case errors.Is(err, sql.ErrNoRows):
 			return ErrEditConflict
 		default:
-			return err
+			return contextError(ctx, err)
 		}
 	}
 	return nil
 }
+
+// GetOrCreateForIdentity returns the user linked to an identity of an OpenID
+// Connect issuer. An identity that is not linked yet is linked to the user
+// with the same email address, which is created if it does not exist. The
+// issuer has verified the email address, so the user is activated as well.
+func (m UserModel) GetOrCreateForIdentity(ctx context.Context, issuer, subject, email, locale string) (*User, error) {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	var user User
+
+	query := `
+		SELECT users.id, users.email, users.created_at, users.last_updated, users.activated, users.locale, users.role, users.suspended
+		FROM users
+		INNER JOIN user_identities ON users.id = user_identities.user_id
+		WHERE user_identities.issuer = $1
+		AND user_identities.subject = $2`
+
+	err = tx.QueryRowContext(ctx, query, issuer, subject).Scan(
+		&user.ID,
+		&user.Email,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
+	)
+	switch {
+	case err == nil:
+		return &user, nil
+	case !errors.Is(err, sql.ErrNoRows):
+		return nil, contextError(ctx, err)
+	}
+
+	query = `
+		INSERT INTO users (email, activated, locale)
+		VALUES ($1, true, $2)
+		ON CONFLICT (email) DO UPDATE SET activated = true, last_updated = NOW()
+		RETURNING id, email, created_at, last_updated, activated, locale, role, suspended`
+
+	err = tx.QueryRowContext(ctx, query, email, locale).Scan(
+		&user.ID,
+		&user.Email,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
+	)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	query = `
+		INSERT INTO user_identities (issuer, subject, user_id)
+		VALUES ($1, $2, $3)`
+
+	_, err = tx.ExecContext(ctx, query, issuer, subject, user.ID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return &user, nil
+}
+
+// ChangeEmailForToken redeems an email change token. It sets the email address
+// the token was issued for and revokes every token of the user, which signs
+// the user out everywhere.
+func (m UserModel) ChangeEmailForToken(ctx context.Context, tokenPlaintext string) (*User, error) {
+	tokenHash := sha256.Sum256([]byte(tokenPlaintext))
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET email = tokens.new_email, last_updated = NOW()
+		FROM tokens
+		WHERE users.id = tokens.user_id
+		AND tokens.hash = $1
+		AND tokens.scope = $2
+		AND tokens.expiry > $3
+		AND tokens.new_email IS NOT NULL
+		RETURNING users.id, users.email, users.created_at, users.last_updated, users.activated, users.locale, users.role, users.suspended`
+
+	args := []interface{}{tokenHash[:], ScopeEmailChange, time.Now()}
+
+	var user User
+
+	err = tx.QueryRowContext(ctx, query, args...).Scan(
+		&user.ID,
+		&user.Email,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
+	)
+	if err != nil {
+		switch {
+		case err.Error() == `pq: duplicate key value violates unique constraint "users_email_key"`:
+			return nil, ErrDuplicateEmail
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	_, err = tx.ExecContext(ctx, `DELETE FROM tokens WHERE user_id = $1`, user.ID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return &user, nil
+}
+
+type UserFilter struct {
+	Search    string
+	Role      string
+	Suspended *bool
+}
+
+func (m UserModel) Get(ctx context.Context, id int64) (*User, error) {
+	if id < 1 {
+		return nil, ErrRecordNotFound
+	}
+
+	query := `
+		SELECT id, email, created_at, last_updated, activated, locale, role, suspended
+		FROM users
+		WHERE id = $1`
+
+	var user User
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, id).Scan(
+		&user.ID,
+		&user.Email,
+		&user.CreatedAt,
+		&user.LastUpdated,
+		&user.Activated,
+		&user.Locale,
+		&user.Role,
+		&user.Suspended,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &user, nil
+}
+
+func (m UserModel) GetAll(ctx context.Context, filter UserFilter, filters Filters) ([]*User, Metadata, error) {
+	query := fmt.Sprintf(`
+		SELECT count(*) OVER(), id, email, created_at, last_updated, activated, locale, role, suspended
+		FROM users
+		WHERE ($1 = '' OR strpos(lower(email), lower($1)) > 0)
+		AND (role = $2 OR $2 = '')
+		AND ($3::boolean IS NULL OR suspended = $3)
+		ORDER BY %s %s, id ASC
+		LIMIT $4 OFFSET $5`, filters.sortColumn(), filters.sortDirection())
+
+	suspended := sql.NullBool{}
+	if filter.Suspended != nil {
+		suspended = sql.NullBool{Bool: *filter.Suspended, Valid: true}
+	}
+
+	args := []interface{}{filter.Search, filter.Role, suspended, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	users := []*User{}
+
+	for rows.Next() {
+		var user User
+		err := rows.Scan(
+			&totalRecords,
+			&user.ID,
+			&user.Email,
+			&user.CreatedAt,
+			&user.LastUpdated,
+			&user.Activated,
+			&user.Locale,
+			&user.Role,
+			&user.Suspended,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		users = append(users, &user)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return users, metadata, nil
+}
+
+// SetSuspended suspends or reactivates a user. Suspending also revokes the
+// authentication tokens of the user.
+func (m UserModel) SetSuspended(ctx context.Context, user *User, suspended bool) error {
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	tx, err := m.DB.BeginTx(ctx, nil)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+	defer tx.Rollback()
+
+	query := `
+		UPDATE users
+		SET suspended = $1, last_updated = NOW()
+		WHERE id = $2
+		RETURNING last_updated`
+
+	err = tx.QueryRowContext(ctx, query, suspended, user.ID).Scan(&user.LastUpdated)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrRecordNotFound
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	if suspended {
+		query = `
+			DELETE FROM tokens
+			WHERE user_id = $1 AND scope IN ($2, $3)`
+
+		_, err = tx.ExecContext(ctx, query, user.ID, ScopeAuthentication, ScopeTwoFactor)
+		if err != nil {
+			return contextError(ctx, err)
+		}
+	}
+
+	err = tx.Commit()
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	user.Suspended = suspended
+	return nil
+}
+
+func (m UserModel) SetRole(ctx context.Context, email, role string) error {
+	query := `
+		UPDATE users
+		SET role = $1, last_updated = NOW()
+		WHERE email = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, role, email)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
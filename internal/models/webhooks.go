@@ -0,0 +1,461 @@
+package models
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net/url"
+	"time"
+
+	"github.com/lib/pq"
+
+	"github.com/Li-Elias/Railclone/internal/validator"
+)
+
+const (
+	EventDeploymentCreated       = "deployment.created"
+	EventDeploymentUpdated       = "deployment.updated"
+	EventDeploymentDeleted       = "deployment.deleted"
+	EventDeploymentStatusChanged = "deployment.status_changed"
+	EventBackupCompleted         = "backup.completed"
+)
+
+// WebhookEvents are the events webhooks can subscribe to. Nothing emits
+// backup.completed until deployments can be backed up.
+var WebhookEvents = []string{
+	EventDeploymentCreated,
+	EventDeploymentUpdated,
+	EventDeploymentDeleted,
+	EventDeploymentStatusChanged,
+	EventBackupCompleted,
+}
+
+const (
+	DeliveryPending   = "pending"
+	DeliveryDelivered = "delivered"
+	DeliveryDead      = "dead"
+)
+
+type Webhook struct {
+	ID          int64     `json:"id"`
+	UserID      int64     `json:"-"`
+	URL         string    `json:"url"`
+	Secret      string    `json:"secret,omitempty"`
+	Events      []string  `json:"events"`
+	Active      bool      `json:"active"`
+	CreatedAt   time.Time `json:"created_at"`
+	LastUpdated time.Time `json:"last_updated"`
+	Version     int32     `json:"version"`
+}
+
+type WebhookDelivery struct {
+	ID             int64           `json:"id"`
+	WebhookID      int64           `json:"webhook_id"`
+	Event          string          `json:"event"`
+	Payload        json.RawMessage `json:"payload"`
+	Status         string          `json:"status"`
+	Attempts       int             `json:"attempts"`
+	NextAttemptAt  time.Time       `json:"next_attempt_at"`
+	ResponseStatus int             `json:"response_status,omitempty"`
+	LastError      string          `json:"last_error,omitempty"`
+	CreatedAt      time.Time       `json:"created_at"`
+	DeliveredAt    *time.Time      `json:"delivered_at,omitempty"`
+	URL            string          `json:"-"`
+	Secret         string          `json:"-"`
+}
+
+func ValidateWebhook(v *validator.Validator, webhook *Webhook) {
+	v.Check(webhook.URL != "", "url", "must be provided")
+	v.Check(len(webhook.URL) <= 2048, "url", "must not be more than 2048 bytes long")
+
+	u, err := url.Parse(webhook.URL)
+	v.Check(err == nil && validator.PermittedValue(u.Scheme, "https", "http") && u.Host != "", "url", "must be an absolute http or https URL")
+
+	v.Check(len(webhook.Events) > 0, "events", "must contain at least 1 event")
+	v.Check(validator.Unique(webhook.Events), "events", "must not contain duplicate values")
+	for _, event := range webhook.Events {
+		v.Check(validator.PermittedValue(event, WebhookEvents...), "events", "must only contain known events")
+	}
+}
+
+// GenerateWebhookSecret returns a random secret to sign the payloads of a
+// webhook with.
+func GenerateWebhookSecret() (string, error) {
+	randomBytes := make([]byte, 32)
+
+	_, err := rand.Read(randomBytes)
+	if err != nil {
+		return "", err
+	}
+
+	return "whsec_" + hex.EncodeToString(randomBytes), nil
+}
+
+type WebhookModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+func (m WebhookModel) Insert(ctx context.Context, webhook *Webhook) error {
+	query := `
+		INSERT INTO webhooks (user_id, url, secret, events, active)
+		VALUES ($1, $2, $3, $4, $5)
+		RETURNING id, created_at, last_updated, version`
+
+	args := []interface{}{webhook.UserID, webhook.URL, webhook.Secret, pq.Array(webhook.Events), webhook.Active}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.ID, &webhook.CreatedAt, &webhook.LastUpdated, &webhook.Version)
+
+	return contextError(ctx, err)
+}
+
+func (m WebhookModel) GetFromUser(ctx context.Context, id int64, userID int64) (*Webhook, error) {
+	query := `
+		SELECT id, user_id, url, events, active, created_at, last_updated, version
+		FROM webhooks
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var webhook Webhook
+
+	err := m.DB.QueryRowContext(ctx, query, id, userID).Scan(
+		&webhook.ID,
+		&webhook.UserID,
+		&webhook.URL,
+		pq.Array(&webhook.Events),
+		&webhook.Active,
+		&webhook.CreatedAt,
+		&webhook.LastUpdated,
+		&webhook.Version,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &webhook, nil
+}
+
+func (m WebhookModel) GetAllForUser(ctx context.Context, userID int64) ([]*Webhook, error) {
+	query := `
+		SELECT id, user_id, url, events, active, created_at, last_updated, version
+		FROM webhooks
+		WHERE user_id = $1
+		ORDER BY id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, userID)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	webhooks := []*Webhook{}
+
+	for rows.Next() {
+		var webhook Webhook
+		err := rows.Scan(
+			&webhook.ID,
+			&webhook.UserID,
+			&webhook.URL,
+			pq.Array(&webhook.Events),
+			&webhook.Active,
+			&webhook.CreatedAt,
+			&webhook.LastUpdated,
+			&webhook.Version,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		webhooks = append(webhooks, &webhook)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return webhooks, nil
+}
+
+func (m WebhookModel) Update(ctx context.Context, webhook *Webhook) error {
+	query := `
+		UPDATE webhooks
+		SET url = $1, events = $2, active = $3, last_updated = NOW(), version = version + 1
+		WHERE id = $4 AND user_id = $5 AND version = $6
+		RETURNING last_updated, version`
+
+	args := []interface{}{webhook.URL, pq.Array(webhook.Events), webhook.Active, webhook.ID, webhook.UserID, webhook.Version}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	err := m.DB.QueryRowContext(ctx, query, args...).Scan(&webhook.LastUpdated, &webhook.Version)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return ErrEditConflict
+		default:
+			return contextError(ctx, err)
+		}
+	}
+
+	return nil
+}
+
+func (m WebhookModel) DeleteFromUser(ctx context.Context, id int64, userID int64) error {
+	query := `
+		DELETE FROM webhooks
+		WHERE id = $1 AND user_id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	result, err := m.DB.ExecContext(ctx, query, id, userID)
+	if err != nil {
+		return contextError(ctx, err)
+	}
+
+	rowsAffected, err := result.RowsAffected()
+	if err != nil {
+		return err
+	}
+
+	if rowsAffected == 0 {
+		return ErrRecordNotFound
+	}
+
+	return nil
+}
+
+type WebhookDeliveryModel struct {
+	DB      *sql.DB
+	Timeout time.Duration
+}
+
+// Enqueue queues a delivery of the event to every active webhook of the user
+// that subscribed to it.
+func (m WebhookDeliveryModel) Enqueue(ctx context.Context, userID int64, event string, payload []byte) error {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT id, $1, $2
+		FROM webhooks
+		WHERE user_id = $3 AND active AND $1 = ANY(events)`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, event, string(payload), userID)
+
+	return contextError(ctx, err)
+}
+
+// Redeliver queues a new delivery of the same payload as an earlier one of
+// the webhook.
+func (m WebhookDeliveryModel) Redeliver(ctx context.Context, id int64, webhookID int64) (*WebhookDelivery, error) {
+	query := `
+		INSERT INTO webhook_deliveries (webhook_id, event, payload)
+		SELECT webhook_id, event, payload
+		FROM webhook_deliveries
+		WHERE id = $1 AND webhook_id = $2
+		RETURNING id, webhook_id, event, payload, status, attempts, next_attempt_at, created_at`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	var delivery WebhookDelivery
+
+	err := m.DB.QueryRowContext(ctx, query, id, webhookID).Scan(
+		&delivery.ID,
+		&delivery.WebhookID,
+		&delivery.Event,
+		&delivery.Payload,
+		&delivery.Status,
+		&delivery.Attempts,
+		&delivery.NextAttemptAt,
+		&delivery.CreatedAt,
+	)
+	if err != nil {
+		switch {
+		case errors.Is(err, sql.ErrNoRows):
+			return nil, ErrRecordNotFound
+		default:
+			return nil, contextError(ctx, err)
+		}
+	}
+
+	return &delivery, nil
+}
+
+// Claim picks up to limit deliveries that are due, together with the URL and
+// secret of their webhook, and pushes their next attempt back by lease like
+// OutboxModel.Claim.
+func (m WebhookDeliveryModel) Claim(ctx context.Context, limit int, lease time.Duration) ([]*WebhookDelivery, error) {
+	query := `
+		WITH claimed AS (
+			UPDATE webhook_deliveries
+			SET attempts = attempts + 1, next_attempt_at = $1
+			WHERE id IN (
+				SELECT id
+				FROM webhook_deliveries
+				WHERE status = 'pending' AND next_attempt_at <= NOW()
+				ORDER BY next_attempt_at
+				LIMIT $2
+				FOR UPDATE SKIP LOCKED
+			)
+			RETURNING id, webhook_id, event, payload, status, attempts, next_attempt_at, created_at
+		)
+		SELECT claimed.id, claimed.webhook_id, claimed.event, claimed.payload, claimed.status, claimed.attempts,
+			claimed.next_attempt_at, claimed.created_at, webhooks.url, webhooks.secret
+		FROM claimed
+		INNER JOIN webhooks ON webhooks.id = claimed.webhook_id`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, time.Now().Add(lease), limit)
+	if err != nil {
+		return nil, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.CreatedAt,
+			&delivery.URL,
+			&delivery.Secret,
+		)
+		if err != nil {
+			return nil, contextError(ctx, err)
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, contextError(ctx, err)
+	}
+
+	return deliveries, nil
+}
+
+func (m WebhookDeliveryModel) MarkDelivered(ctx context.Context, id int64, responseStatus int) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'delivered', response_status = $1, last_error = '', delivered_at = NOW()
+		WHERE id = $2`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, id)
+
+	return contextError(ctx, err)
+}
+
+func (m WebhookDeliveryModel) MarkFailed(ctx context.Context, id int64, responseStatus int, lastError string, nextAttemptAt time.Time) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET response_status = $1, last_error = $2, next_attempt_at = $3
+		WHERE id = $4`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, lastError, nextAttemptAt, id)
+
+	return contextError(ctx, err)
+}
+
+// MarkDead gives up on a delivery after its last failed attempt. It stays in
+// the delivery log and can still be redelivered.
+func (m WebhookDeliveryModel) MarkDead(ctx context.Context, id int64, responseStatus int, lastError string) error {
+	query := `
+		UPDATE webhook_deliveries
+		SET status = 'dead', response_status = $1, last_error = $2
+		WHERE id = $3`
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	_, err := m.DB.ExecContext(ctx, query, responseStatus, lastError, id)
+
+	return contextError(ctx, err)
+}
+
+func (m WebhookDeliveryModel) GetAllForWebhook(ctx context.Context, webhookID int64, status string, filters Filters) ([]*WebhookDelivery, Metadata, error) {
+	query := `
+		SELECT count(*) OVER(), id, webhook_id, event, payload, status, attempts, next_attempt_at,
+			response_status, last_error, created_at, delivered_at
+		FROM webhook_deliveries
+		WHERE webhook_id = $1
+		AND (status = $2 OR $2 = '')
+		ORDER BY id DESC
+		LIMIT $3 OFFSET $4`
+
+	args := []interface{}{webhookID, status, filters.limit(), filters.offset()}
+
+	ctx, cancel := context.WithTimeout(ctx, m.Timeout)
+	defer cancel()
+
+	rows, err := m.DB.QueryContext(ctx, query, args...)
+	if err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+	defer rows.Close()
+
+	totalRecords := 0
+	deliveries := []*WebhookDelivery{}
+
+	for rows.Next() {
+		var delivery WebhookDelivery
+		err := rows.Scan(
+			&totalRecords,
+			&delivery.ID,
+			&delivery.WebhookID,
+			&delivery.Event,
+			&delivery.Payload,
+			&delivery.Status,
+			&delivery.Attempts,
+			&delivery.NextAttemptAt,
+			&delivery.ResponseStatus,
+			&delivery.LastError,
+			&delivery.CreatedAt,
+			&delivery.DeliveredAt,
+		)
+		if err != nil {
+			return nil, Metadata{}, contextError(ctx, err)
+		}
+
+		deliveries = append(deliveries, &delivery)
+	}
+	if err = rows.Err(); err != nil {
+		return nil, Metadata{}, contextError(ctx, err)
+	}
+
+	metadata := calculateMetadata(totalRecords, filters.Page, filters.PageSize)
+
+	return deliveries, metadata, nil
+}
@@ -0,0 +1,156 @@
+package oidc
+
+import (
+	"context"
+	"crypto/rand"
+	"encoding/base64"
+	"errors"
+	"fmt"
+
+	"github.com/coreos/go-oidc/v3/oidc"
+	"golang.org/x/oauth2"
+)
+
+var (
+	ErrMissingIDToken    = errors.New("token response does not contain an id_token")
+	ErrNonceMismatch     = errors.New("id_token nonce does not match the login")
+	ErrUnverifiedEmail   = errors.New("identity provider has not verified the email address")
+	ErrMissingEmailClaim = errors.New("id_token does not contain an email claim")
+)
+
+type Config struct {
+	Issuer       string
+	ClientID     string
+	ClientSecret string
+	RedirectURL  string
+}
+
+func (cfg *Config) Enabled() bool {
+	return cfg.Issuer != ""
+}
+
+type Provider struct {
+	issuer   string
+	oauth2   oauth2.Config
+	verifier *oidc.IDTokenVerifier
+}
+
+type Identity struct {
+	Issuer  string
+	Subject string
+	Email   string
+}
+
+// Login holds the values that have to be kept between redirecting the user to
+// the identity provider and handling the callback.
+type Login struct {
+	State        string
+	Nonce        string
+	CodeVerifier string
+}
+
+// New discovers the endpoints and signing keys of the issuer.
+func New(ctx context.Context, cfg *Config) (*Provider, error) {
+	provider, err := oidc.NewProvider(ctx, cfg.Issuer)
+	if err != nil {
+		return nil, err
+	}
+
+	return &Provider{
+		issuer: cfg.Issuer,
+		oauth2: oauth2.Config{
+			ClientID:     cfg.ClientID,
+			ClientSecret: cfg.ClientSecret,
+			RedirectURL:  cfg.RedirectURL,
+			Endpoint:     provider.Endpoint(),
+			Scopes:       []string{oidc.ScopeOpenID, "email"},
+		},
+		verifier: provider.Verifier(&oidc.Config{ClientID: cfg.ClientID}),
+	}, nil
+}
+
+func NewLogin() (*Login, error) {
+	state, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	nonce, err := randomString()
+	if err != nil {
+		return nil, err
+	}
+
+	return &Login{
+		State:        state,
+		Nonce:        nonce,
+		CodeVerifier: oauth2.GenerateVerifier(),
+	}, nil
+}
+
+// AuthCodeURL returns the URL of the identity provider that starts the
+// authorization code flow with PKCE for the login.
+func (p *Provider) AuthCodeURL(login *Login) string {
+	return p.oauth2.AuthCodeURL(
+		login.State,
+		oidc.Nonce(login.Nonce),
+		oauth2.S256ChallengeOption(login.CodeVerifier),
+	)
+}
+
+// Exchange redeems the authorization code, verifies the returned ID token and
+// returns the identity it asserts. Only verified email addresses are accepted,
+// since they are used to link the identity to an existing user.
+func (p *Provider) Exchange(ctx context.Context, login *Login, code string) (*Identity, error) {
+	token, err := p.oauth2.Exchange(ctx, code, oauth2.VerifierOption(login.CodeVerifier))
+	if err != nil {
+		return nil, err
+	}
+
+	rawIDToken, ok := token.Extra("id_token").(string)
+	if !ok {
+		return nil, ErrMissingIDToken
+	}
+
+	idToken, err := p.verifier.Verify(ctx, rawIDToken)
+	if err != nil {
+		return nil, err
+	}
+
+	if idToken.Nonce != login.Nonce {
+		return nil, ErrNonceMismatch
+	}
+
+	var claims struct {
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+	}
+
+	err = idToken.Claims(&claims)
+	if err != nil {
+		return nil, fmt.Errorf("decode id_token claims: %w", err)
+	}
+
+	switch {
+	case claims.Email == "":
+		return nil, ErrMissingEmailClaim
+	case !claims.EmailVerified:
+		return nil, ErrUnverifiedEmail
+	}
+
+	return &Identity{
+		Issuer:  p.issuer,
+		Subject: idToken.Subject,
+		Email:   claims.Email,
+	}, nil
+}
+
+func randomString() (string, error) {
+	b := make([]byte, 32)
+
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
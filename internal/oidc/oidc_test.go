@@ -0,0 +1,141 @@
+package oidc_test
+
+import (
+	"context"
+	"errors"
+	"net/http"
+	"net/url"
+	"testing"
+
+	"github.com/Li-Elias/Railclone/internal/oidc"
+	"github.com/Li-Elias/Railclone/internal/oidc/oidctest"
+)
+
+const redirectURL = "https://railclone.test/v1/tokens/oidc/callback"
+
+func newProvider(t *testing.T) (*oidctest.Server, *oidc.Provider) {
+	t.Helper()
+
+	server, err := oidctest.NewServer("railclone")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(server.Close)
+
+	provider, err := oidc.New(context.Background(), &oidc.Config{
+		Issuer:       server.Issuer(),
+		ClientID:     "railclone",
+		ClientSecret: "secret",
+		RedirectURL:  redirectURL,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	return server, provider
+}
+
+// authorize follows the authorization URL of the login and returns the code
+// the provider redirects back with.
+func authorize(t *testing.T, provider *oidc.Provider, login *oidc.Login) string {
+	t.Helper()
+
+	client := &http.Client{
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+
+	res, err := client.Get(provider.AuthCodeURL(login))
+	if err != nil {
+		t.Fatal(err)
+	}
+	res.Body.Close()
+
+	location, err := url.Parse(res.Header.Get("Location"))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	qs := location.Query()
+	if qs.Get("error") != "" {
+		t.Fatalf("authorization failed: %s", qs.Get("error"))
+	}
+	if qs.Get("state") != login.State {
+		t.Fatalf("got state %q; want %q", qs.Get("state"), login.State)
+	}
+
+	return qs.Get("code")
+}
+
+func TestExchange(t *testing.T) {
+	server, provider := newProvider(t)
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	identity, err := provider.Exchange(context.Background(), login, authorize(t, provider, login))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	want := oidc.Identity{Issuer: server.Issuer(), Subject: server.Subject, Email: server.Email}
+	if *identity != want {
+		t.Errorf("got identity %+v; want %+v", *identity, want)
+	}
+}
+
+func TestExchangeRejectsWrongCodeVerifier(t *testing.T) {
+	_, provider := newProvider(t)
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, provider, login)
+
+	other, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	login.CodeVerifier = other.CodeVerifier
+
+	_, err = provider.Exchange(context.Background(), login, code)
+	if err == nil {
+		t.Error("got no error for a code redeemed with another verifier")
+	}
+}
+
+func TestExchangeRejectsWrongNonce(t *testing.T) {
+	_, provider := newProvider(t)
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code := authorize(t, provider, login)
+
+	login.Nonce = "another nonce"
+
+	_, err = provider.Exchange(context.Background(), login, code)
+	if !errors.Is(err, oidc.ErrNonceMismatch) {
+		t.Errorf("got error %v; want %v", err, oidc.ErrNonceMismatch)
+	}
+}
+
+func TestExchangeRejectsUnverifiedEmail(t *testing.T) {
+	server, provider := newProvider(t)
+	server.EmailVerified = false
+
+	login, err := oidc.NewLogin()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	_, err = provider.Exchange(context.Background(), login, authorize(t, provider, login))
+	if !errors.Is(err, oidc.ErrUnverifiedEmail) {
+		t.Errorf("got error %v; want %v", err, oidc.ErrUnverifiedEmail)
+	}
+}
@@ -0,0 +1,72 @@
+package openapi
+
+import (
+	_ "embed"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"strings"
+)
+
+//go:embed openapi.json
+var Spec []byte
+
+// Docs is an HTML page rendering Spec, served next to it.
+//
+//go:embed docs.html
+var Docs []byte
+
+// Operations returns the operations of Spec as "METHOD /path" strings, with
+// the paths prefixed by the URL of their server.
+func Operations() ([]string, error) {
+	type server struct {
+		URL string `json:"url"`
+	}
+
+	var doc struct {
+		Servers []server                              `json:"servers"`
+		Paths   map[string]map[string]json.RawMessage `json:"paths"`
+	}
+
+	err := json.Unmarshal(Spec, &doc)
+	if err != nil {
+		return nil, err
+	}
+
+	var operations []string
+	for path, item := range doc.Paths {
+		servers := doc.Servers
+		if raw, ok := item["servers"]; ok {
+			servers = nil
+			err = json.Unmarshal(raw, &servers)
+			if err != nil {
+				return nil, err
+			}
+		}
+
+		prefix := ""
+		if len(servers) > 0 {
+			prefix = strings.TrimSuffix(servers[0].URL, "/")
+		}
+
+		for method := range item {
+			method = strings.ToUpper(method)
+			if !isMethod(method) {
+				continue
+			}
+			operations = append(operations, method+" "+prefix+path)
+		}
+	}
+	sort.Strings(operations)
+
+	return operations, nil
+}
+
+func isMethod(method string) bool {
+	switch method {
+	case http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions, http.MethodTrace:
+		return true
+	}
+	return false
+}
@@ -0,0 +1,56 @@
+package ratelimit
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+type window struct {
+	count int
+	reset time.Time
+}
+
+// MemoryLimiter counts requests in fixed windows in process memory. Every
+// replica keeps its own counts, so it is only meant for single instances and
+// as a fallback when Redis is unavailable.
+type MemoryLimiter struct {
+	mu        sync.Mutex
+	windows   map[string]*window
+	lastSweep time.Time
+}
+
+func NewMemoryLimiter() *MemoryLimiter {
+	return &MemoryLimiter{windows: make(map[string]*window)}
+}
+
+func (l *MemoryLimiter) Allow(ctx context.Context, key string, limit int, period time.Duration) (Result, error) {
+	now := time.Now()
+
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	if now.Sub(l.lastSweep) > time.Minute {
+		for k, w := range l.windows {
+			if now.After(w.reset) {
+				delete(l.windows, k)
+			}
+		}
+		l.lastSweep = now
+	}
+
+	w, ok := l.windows[key]
+	if !ok || now.After(w.reset) {
+		w = &window{reset: now.Add(period)}
+		l.windows[key] = w
+	}
+
+	w.count++
+
+	return Result{
+		Allowed:   w.count <= limit,
+		Limit:     limit,
+		Remaining: max(limit-w.count, 0),
+		Reset:     w.reset.Sub(now),
+	}, nil
+}
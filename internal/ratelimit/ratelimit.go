@@ -0,0 +1,103 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"os"
+	"time"
+)
+
+const (
+	KeyIP    = "ip"
+	KeyUser  = "user"
+	KeyToken = "token"
+)
+
+// Policy limits the requests of each key to Limit per Window. Key selects
+// whether requests are counted per client IP, per user or per authentication
+// token. Anonymous requests are always counted per IP.
+type Policy struct {
+	Limit  int      `json:"limit"`
+	Window Duration `json:"window"`
+	Key    string   `json:"key"`
+}
+
+type Duration time.Duration
+
+func (d *Duration) UnmarshalJSON(b []byte) error {
+	var s string
+
+	err := json.Unmarshal(b, &s)
+	if err != nil {
+		return err
+	}
+
+	parsed, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+
+	*d = Duration(parsed)
+	return nil
+}
+
+func (d Duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+type Result struct {
+	Allowed   bool
+	Limit     int
+	Remaining int
+	Reset     time.Duration
+}
+
+type Limiter interface {
+	Allow(ctx context.Context, key string, limit int, window time.Duration) (Result, error)
+}
+
+func DefaultPolicies() map[string]Policy {
+	return map[string]Policy{
+		"global":      {Limit: 10, Window: Duration(time.Minute), Key: KeyUser},
+		"deployments": {Limit: 5, Window: Duration(time.Minute), Key: KeyUser},
+		"tokens":      {Limit: 5, Window: Duration(time.Minute), Key: KeyIP},
+	}
+}
+
+// LoadPolicies reads policies from a JSON file that maps policy names to
+// policies. They replace the default policies of the same name.
+func LoadPolicies(path string) (map[string]Policy, error) {
+	policies := DefaultPolicies()
+
+	if path == "" {
+		return policies, nil
+	}
+
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var configured map[string]Policy
+
+	err = json.Unmarshal(b, &configured)
+	if err != nil {
+		return nil, fmt.Errorf("parse rate limit policies %s: %w", path, err)
+	}
+
+	for name, policy := range configured {
+		switch {
+		case policy.Limit < 1:
+			return nil, fmt.Errorf("rate limit policy %q: limit must be at least 1", name)
+		case policy.Window <= 0:
+			return nil, fmt.Errorf("rate limit policy %q: window must be positive", name)
+		case policy.Key != KeyIP && policy.Key != KeyUser && policy.Key != KeyToken:
+			return nil, fmt.Errorf("rate limit policy %q: key must be one of ip, user or token", name)
+		}
+
+		policies[name] = policy
+	}
+
+	return policies, nil
+}
@@ -0,0 +1,57 @@
+package ratelimit
+
+import (
+	"context"
+	"time"
+
+	"github.com/redis/go-redis/v9"
+)
+
+// incr increments the counter of the current window and starts the window
+// with the first request, in one round trip.
+var incr = redis.NewScript(`
+local count = redis.call("INCR", KEYS[1])
+if count == 1 then
+	redis.call("PEXPIRE", KEYS[1], ARGV[1])
+end
+return {count, redis.call("PTTL", KEYS[1])}
+`)
+
+// RedisLimiter counts requests in fixed windows shared by every replica. When
+// Redis cannot be reached the fallback limiter is used instead, so that an
+// outage neither blocks every request nor disables rate limiting. The Redis
+// error is still returned along with the result of the fallback.
+type RedisLimiter struct {
+	client   *redis.Client
+	fallback Limiter
+}
+
+func NewRedisLimiter(client *redis.Client, fallback Limiter) *RedisLimiter {
+	return &RedisLimiter{
+		client:   client,
+		fallback: fallback,
+	}
+}
+
+func (l *RedisLimiter) Allow(ctx context.Context, key string, limit int, window time.Duration) (Result, error) {
+	values, err := incr.Run(ctx, l.client, []string{"ratelimit:" + key}, window.Milliseconds()).Int64Slice()
+	if err != nil {
+		result, fallbackErr := l.fallback.Allow(ctx, key, limit, window)
+		if fallbackErr != nil {
+			return result, fallbackErr
+		}
+		return result, err
+	}
+
+	count, ttl := int(values[0]), time.Duration(values[1])*time.Millisecond
+	if ttl < 0 {
+		ttl = window
+	}
+
+	return Result{
+		Allowed:   count <= limit,
+		Limit:     limit,
+		Remaining: max(limit-count, 0),
+		Reset:     ttl,
+	}, nil
+}
@@ -36,6 +36,20 @@ func Matches(value string, rx *regexp.Regexp) bool {
 	return rx.MatchString(value)
 }
 
+func PermittedValue[T comparable](value T, permittedValues ...T) bool {
+	return arrContains(value, permittedValues)
+}
+
+func Unique[T comparable](values []T) bool {
+	uniqueValues := make(map[T]bool)
+
+	for _, value := range values {
+		uniqueValues[value] = true
+	}
+
+	return len(values) == len(uniqueValues)
+}
+
 func arrContains[T comparable](x T, arr []T) bool {
 	for _, v := range arr {
 		if v == x {
@@ -0,0 +1,3 @@
+DROP TABLE IF EXISTS deployment_steps;
+
+ALTER TABLE deployments DROP COLUMN IF EXISTS status;
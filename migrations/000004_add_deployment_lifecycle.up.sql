@@ -0,0 +1,13 @@
+ALTER TABLE deployments ADD COLUMN IF NOT EXISTS status text NOT NULL DEFAULT 'ready';
+
+CREATE TABLE IF NOT EXISTS deployment_steps (
+    id bigserial PRIMARY KEY,
+    deployment_id bigint NOT NULL,
+    operation text NOT NULL,
+    step text NOT NULL,
+    state text NOT NULL,
+    error text NOT NULL DEFAULT '',
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS deployment_steps_deployment_id_idx ON deployment_steps (deployment_id);
@@ -0,0 +1 @@
+ALTER TABLE deployments ADD COLUMN IF NOT EXISTS version integer NOT NULL DEFAULT 1;
@@ -0,0 +1 @@
+CREATE INDEX IF NOT EXISTS deployments_user_id_created_at_idx ON deployments (user_id, created_at);
@@ -0,0 +1,10 @@
+CREATE TABLE IF NOT EXISTS token_requests (
+    id bigserial PRIMARY KEY,
+    email citext NOT NULL,
+    ip text NOT NULL,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS token_requests_email_idx ON token_requests (email, created_at);
+CREATE INDEX IF NOT EXISTS token_requests_ip_idx ON token_requests (ip, created_at);
+CREATE INDEX IF NOT EXISTS token_requests_created_at_idx ON token_requests (created_at);
@@ -0,0 +1,4 @@
+DROP TRIGGER IF EXISTS deployments_record_change ON deployments;
+DROP FUNCTION IF EXISTS record_deployment_change();
+DROP TABLE IF EXISTS deployment_events;
+DROP FUNCTION IF EXISTS notify_deployment_event();
@@ -0,0 +1,67 @@
+-- user_id has no foreign key, so that deleting a user can still record the
+-- deletion of their deployments
+CREATE TABLE IF NOT EXISTS deployment_events (
+    id bigserial PRIMARY KEY,
+    user_id bigint NOT NULL,
+    deployment_id bigint NOT NULL,
+    type text NOT NULL,
+    data jsonb NOT NULL,
+    source_key text UNIQUE,
+    created_at timestamp(0) with time zone NOT NULL DEFAULT NOW()
+);
+
+CREATE INDEX IF NOT EXISTS deployment_events_user_id_idx ON deployment_events (user_id, id);
+CREATE INDEX IF NOT EXISTS deployment_events_created_at_idx ON deployment_events (created_at);
+
+CREATE OR REPLACE FUNCTION notify_deployment_event() RETURNS trigger AS $$
+BEGIN
+    PERFORM pg_notify('deployment_events', NEW.id::text);
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS deployment_events_notify ON deployment_events;
+CREATE TRIGGER deployment_events_notify
+    AFTER INSERT ON deployment_events
+    FOR EACH ROW EXECUTE FUNCTION notify_deployment_event();
+
+-- every change of a deployment record is recorded as an event, without the
+-- env vars that hold its credentials
+CREATE OR REPLACE FUNCTION record_deployment_change() RETURNS trigger AS $$
+DECLARE
+    d deployments;
+    event_type text;
+BEGIN
+    IF TG_OP = 'INSERT' THEN
+        d := NEW;
+        event_type := 'deployment.created';
+    ELSIF TG_OP = 'UPDATE' THEN
+        d := NEW;
+        event_type := 'deployment.updated';
+    ELSE
+        d := OLD;
+        event_type := 'deployment.deleted';
+    END IF;
+
+    INSERT INTO deployment_events (user_id, deployment_id, type, data)
+    VALUES (d.user_id, d.id, event_type, json_build_object(
+        'id', d.id,
+        'image', d.image,
+        'port', d.port,
+        'volume', d.volume,
+        'replicas', d.replicas,
+        'created_at', d.created_at,
+        'last_updated', d.last_updated,
+        'running', d.running,
+        'status', d.status,
+        'version', d.version
+    ));
+
+    RETURN NULL;
+END;
+$$ LANGUAGE plpgsql;
+
+DROP TRIGGER IF EXISTS deployments_record_change ON deployments;
+CREATE TRIGGER deployments_record_change
+    AFTER INSERT OR UPDATE OR DELETE ON deployments
+    FOR EACH ROW EXECUTE FUNCTION record_deployment_change();
@@ -0,0 +1,4 @@
+CREATE TABLE IF NOT EXISTS used_challenges (
+    id bytea PRIMARY KEY,
+    expiry timestamp(0) with time zone NOT NULL
+);
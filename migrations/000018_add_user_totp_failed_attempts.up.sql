@@ -0,0 +1 @@
+ALTER TABLE user_totp ADD COLUMN IF NOT EXISTS failed_attempts integer NOT NULL DEFAULT 0;